@@ -0,0 +1,175 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The formats the access log can be written in.
+const (
+	CombinedLogFormat = "combined"
+	JSONLogFormat     = "json"
+)
+
+// The timestamp layout of the Combined Log Format.
+const combinedTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// The query parameters whose values are left out of the access log.
+// Unsubscribe links carry a token which stops a person's reminders.
+var sensitiveQueryParameters = map[string]bool{
+	"token":      true,
+	"password":   true,
+	"csrf-token": true,
+}
+
+// The value logged in place of a sensitive query parameter's.
+const redactedValue = "REDACTED"
+
+// An accessLogger writes a line for each request,
+// whatever the application log level is.
+type accessLogger struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	closer io.Closer
+	format string
+}
+
+// newAccessLogger writes the access log to the file at path,
+// appending to it, or to stdout if path is "-".
+func newAccessLogger(path, format string) (*accessLogger, error) {
+	if format != CombinedLogFormat && format != JSONLogFormat {
+		return nil, fmt.Errorf("Unknown access log format %q, expected %v or %v.", format, CombinedLogFormat, JSONLogFormat)
+	}
+	if path == "-" {
+		return &accessLogger{out: os.Stdout, format: format}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open the access log %v: %v", path, err)
+	}
+	return &accessLogger{out: file, closer: file, format: format}, nil
+}
+
+func (logger *accessLogger) Close() error {
+	if logger.closer == nil {
+		return nil
+	}
+	return logger.closer.Close()
+}
+
+// An accessLogEntry is what is recorded about a request.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteIP   string    `json:"remote_ip"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Protocol   string    `json:"protocol"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// combinedField returns the value, or "-" if it is empty.
+func combinedField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// quotedField escapes the value for a quoted field of the Combined Log Format.
+func quotedField(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(combinedField(value))
+}
+
+// format formats the entry as a line of the access log.
+func (entry *accessLogEntry) format(format string) []byte {
+	if format == JSONLogFormat {
+		line, _ := json.Marshal(entry)
+		return append(line, '\n')
+	}
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+	return []byte(fmt.Sprintf("%v - %v [%v] \"%v %v %v\" %d %v \"%v\" \"%v\"\n",
+		combinedField(entry.RemoteIP),
+		combinedField(strings.Replace(entry.User, " ", "_", -1)),
+		entry.Time.Format(combinedTimeLayout),
+		entry.Method, quotedField(entry.Path), entry.Protocol,
+		entry.Status,
+		bytes,
+		quotedField(entry.Referer),
+		quotedField(entry.UserAgent)))
+}
+
+// redactURI replaces the values of the sensitive query parameters in
+// a url, keeping the rest of it as it was.
+func redactURI(uri string) string {
+	i := strings.Index(uri, "?")
+	if i == -1 {
+		return uri
+	}
+	parameters := strings.Split(uri[i+1:], "&")
+	for j, parameter := range parameters {
+		name := parameter
+		if k := strings.Index(parameter, "="); k != -1 {
+			name = parameter[:k]
+		}
+		unescaped, err := url.QueryUnescape(name)
+		if err == nil && sensitiveQueryParameters[unescaped] {
+			parameters[j] = name + "=" + redactedValue
+		}
+	}
+	return uri[:i+1] + strings.Join(parameters, "&")
+}
+
+// Handler logs each request served by next.
+func (logger *accessLogger) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		entry := &accessLogEntry{
+			Time:       start,
+			RemoteIP:   clientIP(r),
+			Method:     r.Method,
+			Path:       redactURI(r.URL.RequestURI()),
+			Protocol:   r.Proto,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+			Referer:    redactURI(r.Referer()),
+			UserAgent:  r.UserAgent(),
+			RequestID:  requestID(r),
+		}
+		if username, ok := sessionUsername(r); ok {
+			entry.User = username
+		}
+
+		line := entry.format(logger.format)
+		logger.mutex.Lock()
+		defer logger.mutex.Unlock()
+		logger.out.Write(line)
+	})
+}
@@ -0,0 +1,623 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/cu-library/signtwo/audit"
+	"github.com/cu-library/signtwo/db"
+	"github.com/cu-library/signtwo/i18n"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The layout of dates in the admin forms.
+const formDateLayout = "2006-01-02"
+
+// requireLogin returns the logged in user's username, or redirects
+// to the login page and returns false if there isn't one.
+func requireLogin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, ok := sessionUsername(r)
+	if !ok {
+		setFlash(w, r, FlashInfo, "Please log in to continue.")
+		http.Redirect(w, r, urlFor("login"), http.StatusSeeOther)
+	}
+	return username, ok
+}
+
+// requireOwner checks that the logged in user owns the agreement,
+// writing an error page and returning false if they don't. Users who
+// don't own the agreement are shown the not found page, so they can't
+// tell which agreements exist.
+func requireOwner(w http.ResponseWriter, r *http.Request, agreementID int64) bool {
+	username, ok := requireLogin(w, r)
+	if !ok {
+		return false
+	}
+	isOwner, err := db.IsOwner(agreementID, username)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to check ownership of agreement %v: %v", agreementID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return false
+	}
+	if !isOwner {
+		fourOhFour(w, r)
+		return false
+	}
+	return true
+}
+
+// routeID parses the {id} route variable.
+func routeID(r *http.Request) int64 {
+	// The route pattern only matches digits, so the only possible error is overflow.
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	return id
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Admin Handler visited.")
+
+	username, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+
+	agreements, err := db.AgreementsOwnedBy(username)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load agreements owned by %v: %v", username, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	renderTemplateOr500(w, r, adminTemplate, map[string]interface{}{
+		"username":   username,
+		"agreements": agreements,
+		"operator":   operatorUsernames[username],
+	})
+}
+
+func agreementEditGETHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Agreement Edit GET Handler visited.")
+
+	agreement, ok := loadOwnedAgreement(w, r)
+	if !ok {
+		return
+	}
+
+	data, ok := agreementEditData(w, r, agreement)
+	if !ok {
+		return
+	}
+	renderTemplateOr500(w, r, agreementEditTemplate, data)
+}
+
+// agreementEditData returns the template data shared by every rendering
+// of the agreement edit page. It writes an error page and returns false
+// if it can't.
+func agreementEditData(w http.ResponseWriter, r *http.Request, agreement *db.Agreement) (map[string]interface{}, bool) {
+	texts, err := db.AgreementTexts(agreement.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load texts of agreement %v: %v", agreement.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, false
+	}
+
+	username, _ := sessionUsername(r)
+	owner, err := db.GetOwner(agreement.ID, username)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load %v's ownership of agreement %v: %v", username, agreement.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, false
+	}
+
+	return map[string]interface{}{
+		csrf.TemplateTag: customTokenField(r),
+		"agreement":      agreement,
+		"texts":          texts,
+		"owner":          owner,
+		"mailEnabled":    mailQueue != nil,
+	}, true
+}
+
+// ownerNotificationsPOSTHandler sets whether the owner is emailed when
+// someone signs the agreement.
+func ownerNotificationsPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Owner Notifications POST Handler visited.")
+
+	agreement, ok := loadOwnedAgreement(w, r)
+	if !ok {
+		return
+	}
+	username, _ := sessionUsername(r)
+	owner, err := db.GetOwner(agreement.ID, username)
+	if err == nil {
+		err = owner.SetNotifySignatures(r.FormValue("notify") == "on")
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to change %v's notifications of agreement %v: %v", username, agreement.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	recordAudit(r, audit.OwnerChange, username, fmt.Sprintf("agreement %d", agreement.ID),
+		fmt.Sprintf("notify of signatures: %v", owner.NotifySignatures))
+
+	setFlash(w, r, FlashSuccess, "Your changes have been saved.")
+	http.Redirect(w, r, urlFor("agreementEdit", "id", agreement.ID), http.StatusSeeOther)
+}
+
+func agreementEditPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Agreement Edit POST Handler visited.")
+
+	stored, ok := loadOwnedAgreement(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	// The edited agreement, based on the version the user loaded.
+	edited := *stored
+	edited.Title = r.FormValue("title")
+	edited.Description = r.FormValue("description")
+	edited.Enabled = r.FormValue("enabled") == "on"
+	edited.Version = version
+
+	_, err = edited.Store()
+	if err == db.ErrConflict {
+		logFor(r).Logf(l.InfoMessage, "Edit conflict on agreement %v.", stored.ID)
+
+		// Reload, as the agreement may have changed again since loadAgreement.
+		current, err := db.GetAgreement(stored.ID)
+		if err != nil {
+			logFor(r).Logf(l.ErrorMessage, "Unable to reload agreement %v: %v", stored.ID, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database Error")
+			return
+		}
+
+		// Keep the user's edit in the form, but against the current version,
+		// so that submitting again deliberately replaces the current values.
+		edited.Version = current.Version
+		data, ok := agreementEditData(w, r, &edited)
+		if !ok {
+			return
+		}
+		data["current"] = current
+		renderTemplateOr500CustomStatus(w, r, agreementEditTemplate, data, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to store agreement %v: %v", stored.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	username, _ := sessionUsername(r)
+	recordAudit(r, audit.AgreementChange, username, fmt.Sprintf("agreement %d", edited.ID),
+		fmt.Sprintf("version %d", edited.Version))
+
+	setFlash(w, r, FlashSuccess, "Your changes have been saved.")
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
+
+func textEditGETHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Text Edit GET Handler visited.")
+
+	text, ok := loadOwnedAgreementText(w, r)
+	if !ok {
+		return
+	}
+
+	signed, err := db.IsSigned(text.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to check signatures of agreement text %v: %v", text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	corrections, err := db.Corrections(0, text.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load corrections of agreement text %v: %v", text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	data, ok := textEditData(w, r, text)
+	if !ok {
+		return
+	}
+	data["signed"] = signed
+	data["corrections"] = corrections
+
+	renderTemplateOr500(w, r, textEditTemplate, data)
+}
+
+// textEditData returns the template data shared by every rendering of
+// the text edit page, including the text's translations. It writes an
+// error page and returns false if it can't.
+func textEditData(w http.ResponseWriter, r *http.Request, text *db.AgreementText) (map[string]interface{}, bool) {
+	translations, err := db.AgreementTextTranslations(text.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load translations of agreement text %v: %v", text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, false
+	}
+	signedLanguages, err := db.SignedLanguages(text.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to check signatures of agreement text %v: %v", text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, false
+	}
+	translated := map[string]bool{}
+	for _, translation := range translations {
+		translated[translation.Language] = true
+	}
+
+	return map[string]interface{}{
+		csrf.TemplateTag:  customTokenField(r),
+		"text":            text,
+		"translations":    translations,
+		"translated":      translated,
+		"signedLanguages": signedLanguages,
+	}, true
+}
+
+func textEditPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Text Edit POST Handler visited.")
+
+	stored, ok := loadOwnedAgreementText(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	enactmentDate, err := time.Parse(formDateLayout, r.FormValue("enactmentdate"))
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	edited := *stored
+	title := r.FormValue("title")
+	edited.Title = sql.NullString{String: title, Valid: title != ""}
+	edited.Content = r.FormValue("content")
+	edited.EnactmentDate = enactmentDate
+	edited.Version = version
+	if language := r.FormValue("language"); i18n.Supported(language) {
+		edited.Language = language
+	}
+	if format := db.TextFormat(r.FormValue("format")); format == db.Markdown || format == db.PlainText {
+		edited.Format = format
+	}
+
+	_, err = edited.Store()
+	if err == db.ErrConflict {
+		logFor(r).Logf(l.InfoMessage, "Edit conflict on agreement text %v.", stored.ID)
+
+		current, err := db.GetAgreementText(stored.ID)
+		if err != nil {
+			logFor(r).Logf(l.ErrorMessage, "Unable to reload agreement text %v: %v", stored.ID, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database Error")
+			return
+		}
+
+		edited.Version = current.Version
+		data, ok := textEditData(w, r, &edited)
+		if !ok {
+			return
+		}
+		data["current"] = current
+		renderTemplateOr500CustomStatus(w, r, textEditTemplate, data, http.StatusConflict)
+		return
+	}
+	if err == db.ErrImmutable {
+		errorPage(w, r, http.StatusConflict, "This text has been signed and can no longer be changed. "+
+			"Record a correction, or create a new text which replaces it.")
+		return
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to store agreement text %v: %v", stored.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	username, _ := sessionUsername(r)
+	recordAudit(r, audit.TextChange, username, fmt.Sprintf("agreement text %d", edited.ID),
+		fmt.Sprintf("version %d, content sha256 %v", edited.Version, db.ContentHash(edited.Content)))
+
+	setFlash(w, r, FlashSuccess, "Your changes have been saved.")
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
+
+// The fields of a signed agreement text which can be corrected.
+var correctableTextFields = map[string]func(*db.AgreementText) string{
+	"title":   func(text *db.AgreementText) string { return text.Title.String },
+	"content": func(text *db.AgreementText) string { return text.Content },
+}
+
+func textCorrectionPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Text Correction POST Handler visited.")
+
+	text, ok := loadOwnedAgreementText(w, r)
+	if !ok {
+		return
+	}
+	username, _ := sessionUsername(r)
+
+	// Texts which haven't been signed can still be edited.
+	signed, err := db.IsSigned(text.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to check signatures of agreement text %v: %v", text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	if !signed {
+		errorPage(w, r, http.StatusConflict, "This text hasn't been signed, so edit it instead of recording a correction.")
+		return
+	}
+
+	field := r.FormValue("field")
+	oldValue, ok := correctableTextFields[field]
+	if !ok {
+		errorPage(w, r, http.StatusBadRequest, "A correction needs a field and a reason.")
+		return
+	}
+	newValue, reason, ok := correctionFromForm(w, r, oldValue(text))
+	if !ok {
+		return
+	}
+
+	correction := db.NewAgreementTextCorrection(text.ID, field, oldValue(text), newValue, username, reason)
+	_, err = correction.Store()
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to store correction of agreement text %v: %v", text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	logFor(r).Logf(l.InfoMessage, "%v corrected the %v of agreement text %v.", username, field, text.ID)
+	recordAudit(r, audit.TextCorrection, username, fmt.Sprintf("agreement text %d", text.ID),
+		fmt.Sprintf("correction %d of %v: %v", correction.ID, field, reason))
+
+	setFlash(w, r, FlashSuccess, "The correction has been recorded.")
+	http.Redirect(w, r, urlFor("textEdit", "id", text.ID), http.StatusSeeOther)
+}
+
+// correctionFromForm returns the corrected value and the reason for a
+// correction of a field whose value is oldValue. It writes an error
+// page and returns false if there's no reason, or the corrected value
+// is empty or unchanged.
+func correctionFromForm(w http.ResponseWriter, r *http.Request, oldValue string) (string, string, bool) {
+	newValue, reason := r.FormValue("newvalue"), strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		errorPage(w, r, http.StatusBadRequest, "A correction needs a field and a reason.")
+		return "", "", false
+	}
+	if strings.TrimSpace(newValue) == "" {
+		errorPage(w, r, http.StatusBadRequest, "The corrected value can't be empty.")
+		return "", "", false
+	}
+	if newValue == oldValue {
+		errorPage(w, r, http.StatusBadRequest, "The corrected value is the same as the current value.")
+		return "", "", false
+	}
+	return newValue, reason, true
+}
+
+// The fields of a signature which can be corrected, the signer's
+// directory details as they were recorded when they signed.
+var correctableSignatureFields = map[string]func(*db.Signature) string{
+	"firstname":  func(signature *db.Signature) string { return signature.FirstName },
+	"lastname":   func(signature *db.Signature) string { return signature.LastName },
+	"email":      func(signature *db.Signature) string { return signature.Email },
+	"department": func(signature *db.Signature) string { return signature.Department },
+}
+
+// loadSignature loads the signature named by the {id} route variable,
+// if the user owns its agreement, writing an error page and returning
+// false if it can't.
+func loadSignature(w http.ResponseWriter, r *http.Request) (*db.Signature, *db.AgreementText, bool) {
+	if _, ok := requireLogin(w, r); !ok {
+		return nil, nil, false
+	}
+	signature, err := db.GetSignature(routeID(r))
+	if err == sql.ErrNoRows {
+		fourOhFour(w, r)
+		return nil, nil, false
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load signature: %v", err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, nil, false
+	}
+	text, err := db.GetAgreementText(signature.SignedAgreementTextID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load agreement text %v: %v", signature.SignedAgreementTextID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, nil, false
+	}
+	if !requireOwner(w, r, text.BaseAgreementID) {
+		return nil, nil, false
+	}
+	return signature, text, true
+}
+
+func signatureGETHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Signature GET Handler visited.")
+
+	signature, text, ok := loadSignature(w, r)
+	if !ok {
+		return
+	}
+	corrections, err := db.Corrections(signature.ID, 0)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load corrections of signature %v: %v", signature.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	renderTemplateOr500(w, r, signatureTemplate, map[string]interface{}{
+		csrf.TemplateTag: customTokenField(r),
+		"signature":      signature,
+		"text":           text,
+		"corrections":    corrections,
+	})
+}
+
+func signatureCorrectionPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Signature Correction POST Handler visited.")
+
+	signature, _, ok := loadSignature(w, r)
+	if !ok {
+		return
+	}
+	username, _ := sessionUsername(r)
+
+	field := r.FormValue("field")
+	oldValue, ok := correctableSignatureFields[field]
+	if !ok {
+		errorPage(w, r, http.StatusBadRequest, "A correction needs a field and a reason.")
+		return
+	}
+	newValue, reason, ok := correctionFromForm(w, r, oldValue(signature))
+	if !ok {
+		return
+	}
+
+	correction := db.NewSignatureCorrection(signature.ID, field, oldValue(signature), newValue, username, reason)
+	_, err := correction.Store()
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to store correction of signature %v: %v", signature.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	logFor(r).Logf(l.InfoMessage, "%v corrected the %v of signature %v.", username, field, signature.ID)
+	recordAudit(r, audit.SignatureCorrection, username, fmt.Sprintf("signature %d", signature.ID),
+		fmt.Sprintf("correction %d of %v: %v", correction.ID, field, reason))
+
+	setFlash(w, r, FlashSuccess, "The correction has been recorded.")
+	http.Redirect(w, r, urlFor("signature", "id", signature.ID), http.StatusSeeOther)
+}
+
+func textTranslationPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Text Translation POST Handler visited.")
+
+	text, ok := loadOwnedAgreementText(w, r)
+	if !ok {
+		return
+	}
+
+	// A text is only translated into the other languages of the user interface.
+	language := r.FormValue("language")
+	if !i18n.Supported(language) || language == text.Language {
+		errorPage(w, r, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	title := sql.NullString{String: r.FormValue("title"), Valid: r.FormValue("title") != ""}
+
+	translation, err := db.GetAgreementTextTranslation(text.ID, language)
+	if err == sql.ErrNoRows {
+		translation = db.NewAgreementTextTranslation(text.ID, language, title, r.FormValue("content"))
+	} else if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the %v translation of agreement text %v: %v", language, text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	} else {
+		// Adding a translation which already exists, from a stale
+		// form, has no version and so conflicts.
+		version, _ := strconv.ParseInt(r.FormValue("version"), 10, 64)
+		translation.Title = title
+		translation.Content = r.FormValue("content")
+		translation.Version = version
+	}
+
+	_, err = translation.Store()
+	if err == db.ErrConflict {
+		logFor(r).Logf(l.InfoMessage, "Edit conflict on the %v translation of agreement text %v.", language, text.ID)
+		errorPage(w, r, http.StatusConflict, "This translation was changed by someone else after you started editing it. "+
+			"Go back, reload the page, and reapply your changes.")
+		return
+	}
+	if err == db.ErrImmutable {
+		errorPage(w, r, http.StatusConflict, "This translation has been signed, so it can no longer be changed.")
+		return
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to store the %v translation of agreement text %v: %v", language, text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	username, _ := sessionUsername(r)
+	recordAudit(r, audit.TextChange, username, fmt.Sprintf("agreement text %d", text.ID),
+		fmt.Sprintf("%v translation version %d, content sha256 %v", language, translation.Version, db.ContentHash(translation.Content)))
+
+	setFlash(w, r, FlashSuccess, "The translation has been saved.")
+	http.Redirect(w, r, urlFor("textEdit", "id", text.ID), http.StatusSeeOther)
+}
+
+// loadAgreement loads the agreement named by the {id} route variable,
+// writing an error page and returning false if it can't.
+func loadAgreement(w http.ResponseWriter, r *http.Request) (*db.Agreement, bool) {
+	agreement, err := db.GetAgreement(routeID(r))
+	if err == sql.ErrNoRows {
+		fourOhFour(w, r)
+		return nil, false
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load agreement: %v", err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, false
+	}
+	return agreement, true
+}
+
+// loadOwnedAgreement loads the agreement named by the {id} route
+// variable, if the logged in user owns it. Ownership is checked first,
+// so agreements which don't exist and agreements owned by someone else
+// look the same. It writes an error page and returns false if it can't.
+func loadOwnedAgreement(w http.ResponseWriter, r *http.Request) (*db.Agreement, bool) {
+	if !requireOwner(w, r, routeID(r)) {
+		return nil, false
+	}
+	return loadAgreement(w, r)
+}
+
+// loadOwnedAgreementText loads the agreement text named by the {id}
+// route variable, if the logged in user owns its agreement, writing an
+// error page and returning false if it can't.
+func loadOwnedAgreementText(w http.ResponseWriter, r *http.Request) (*db.AgreementText, bool) {
+	if _, ok := requireLogin(w, r); !ok {
+		return nil, false
+	}
+	text, ok := loadAgreementText(w, r)
+	if !ok || !requireOwner(w, r, text.BaseAgreementID) {
+		return nil, false
+	}
+	return text, true
+}
+
+// loadAgreementText loads the agreement text named by the {id} route variable,
+// writing an error page and returning false if it can't.
+func loadAgreementText(w http.ResponseWriter, r *http.Request) (*db.AgreementText, bool) {
+	text, err := db.GetAgreementText(routeID(r))
+	if err == sql.ErrNoRows {
+		fourOhFour(w, r)
+		return nil, false
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load agreement text: %v", err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, false
+	}
+	return text, true
+}
@@ -0,0 +1,431 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cu-library/signtwo/i18n"
+	l "github.com/cu-library/signtwo/loglevel"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The templates and static files built into the binary.
+//
+//go:embed templates static
+var embeddedAssets embed.FS
+
+// How long browsers may cache static files requested by their hashed name.
+const staticMaxAge = 365 * 24 * 60 * 60
+
+// The length of the content hash added to static file names.
+const staticHashLength = 10
+
+// The built in static files, and the theme's.
+var staticAssets, themeAssets *staticSet
+
+// Guards the parsed templates and static files, which are replaced when
+// assets read from disk change. It is held for reading while a page or
+// email is rendered, and while a static file is looked up.
+var assetsMutex = new(sync.RWMutex)
+
+// How often the templates read from disk are checked for changes.
+const DefaultAssetsCheckInterval = time.Second
+
+// The page templates, each parsed from base and its own file.
+var pageTemplates = []struct {
+	tmpl *localizedTemplate
+	file string
+}{
+	{&homeTemplate, "home.tmpl"},
+	{&loginTemplate, "login.tmpl"},
+	{&fourOhFourTemplate, "fourohfour.tmpl"},
+	{&adminTemplate, "admin.tmpl"},
+	{&agreementEditTemplate, "agreementedit.tmpl"},
+	{&textEditTemplate, "textedit.tmpl"},
+	{&signaturesTemplate, "signatures.tmpl"},
+	{&signatureTemplate, "signature.tmpl"},
+	{&agreementTemplate, "agreement.tmpl"},
+	{&receiptVerifyTemplate, "receiptverify.tmpl"},
+	{&logLevelsTemplate, "loglevels.tmpl"},
+	{&changesTemplate, "changes.tmpl"},
+	{&badRequestTemplate, "badrequest.tmpl"},
+	{&forbiddenTemplate, "forbidden.tmpl"},
+	{&methodNotAllowedTemplate, "methodnotallowed.tmpl"},
+	{&serverErrorTemplate, "servererror.tmpl"},
+	{&remindersTemplate, "reminders.tmpl"},
+	{&reminderTemplate, "reminder.tmpl"},
+	{&unsubscribeTemplate, "unsubscribe.tmpl"},
+}
+
+func init() {
+	err := loadAssets(embeddedAssets, false, nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// loadAssets parses the templates in the templates directory of assets,
+// including the email templates, once for each language, and serves the
+// files in its static directory. Static files read from
+// disk are served without hashed names or long cache headers, so
+// changes show up on reload.
+//
+// If theme isn't nil, the blocks defined in its templates/theme.tmpl
+// override base's for every page, and the blocks defined in a page's
+// file, like templates/login.tmpl, override that page's. Blocks a theme
+// doesn't define keep their default. The theme's static files are served
+// alongside the built in ones.
+func loadAssets(assets fs.FS, fromDisk bool, theme fs.FS) error {
+	base := localizedTemplate{}
+	parsed := make([]localizedTemplate, len(pageTemplates))
+	for i := range parsed {
+		parsed[i] = localizedTemplate{}
+	}
+
+	for _, language := range i18n.Languages() {
+		localizedBase, err := template.New("base.tmpl").Funcs(templateFuncs).Funcs(localizedFuncs(language)).
+			ParseFS(assets, "templates/base.tmpl")
+		if err != nil {
+			return err
+		}
+		localizedBase, err = parseOverride(localizedBase, theme, "theme.tmpl")
+		if err != nil {
+			return err
+		}
+		base[language] = localizedBase
+
+		for i, page := range pageTemplates {
+			clone, err := localizedBase.Clone()
+			if err != nil {
+				return err
+			}
+			clone, err = clone.ParseFS(assets, "templates/"+page.file)
+			if err != nil {
+				return err
+			}
+			parsed[i][language], err = parseOverride(clone, theme, page.file)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	emails, err := parseEmailTemplates(assets, theme)
+	if err != nil {
+		return err
+	}
+
+	static, err := newStaticSet(assets, fromDisk)
+	if err != nil {
+		return err
+	}
+	var themeStatic *staticSet
+	if theme != nil {
+		themeStatic, err = newStaticSet(theme, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	assetsMutex.Lock()
+	defer assetsMutex.Unlock()
+	baseTemplate.replace(base)
+	for i, page := range pageTemplates {
+		page.tmpl.replace(parsed[i])
+	}
+	for i, email := range emailTemplates {
+		if *email.tmpl == nil {
+			*email.tmpl = emails[i]
+		} else {
+			**email.tmpl = *emails[i]
+		}
+	}
+	staticAssets, themeAssets = static, themeStatic
+	return nil
+}
+
+// replace puts the parsed templates in tmpl. Once set, the map is changed
+// rather than replaced, as handlers pass the template variables around
+// without holding assetsMutex, and only look inside while rendering.
+func (tmpl *localizedTemplate) replace(parsed localizedTemplate) {
+	if *tmpl == nil {
+		*tmpl = parsed
+		return
+	}
+	for language := range *tmpl {
+		if _, ok := parsed[language]; !ok {
+			delete(*tmpl, language)
+		}
+	}
+	for language, languageTemplate := range parsed {
+		(*tmpl)[language] = languageTemplate
+	}
+}
+
+// An assetsReloader parses the templates again when the files in the
+// assets or theme directories change, so edits show up on reload
+// without restarting the server.
+type assetsReloader struct {
+	mutex       sync.Mutex
+	assets      fs.FS
+	fromDisk    bool
+	theme       fs.FS
+	loaded      assetsVersion
+	lastChecked time.Time
+}
+
+// An assetsVersion identifies the state of the template files.
+type assetsVersion struct {
+	modified time.Time
+	files    int
+}
+
+func newAssetsReloader(assets fs.FS, fromDisk bool, theme fs.FS) (*assetsReloader, error) {
+	reloader := &assetsReloader{assets: assets, fromDisk: fromDisk, theme: theme}
+	version, err := reloader.version()
+	if err != nil {
+		return nil, err
+	}
+	reloader.loaded = version
+	return reloader, loadAssets(assets, fromDisk, theme)
+}
+
+// version returns the latest modification time and the number of the
+// template files, so edited, added and removed files are all noticed.
+func (reloader *assetsReloader) version() (assetsVersion, error) {
+	version := assetsVersion{}
+	for _, files := range []fs.FS{reloader.assets, reloader.theme} {
+		if files == nil {
+			continue
+		}
+		err := fs.WalkDir(files, "templates", func(name string, entry fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && name == "templates" {
+				return fs.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(version.modified) {
+				version.modified = info.ModTime()
+			}
+			version.files++
+			return nil
+		})
+		if err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+// reload parses the templates again if they have changed since they
+// were last parsed. If they can't be parsed, the old ones are kept.
+// The files are checked at most once each DefaultAssetsCheckInterval.
+func (reloader *assetsReloader) reload() {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	if time.Since(reloader.lastChecked) < DefaultAssetsCheckInterval {
+		return
+	}
+	reloader.lastChecked = time.Now()
+	version, err := reloader.version()
+	if err != nil {
+		l.Logf(l.ErrorMessage, "Unable to check the templates for changes: %v", err)
+		return
+	}
+	if version == reloader.loaded {
+		return
+	}
+	// The failed version is remembered too, so the error is logged
+	// once, until the files change again.
+	reloader.loaded = version
+	err = loadAssets(reloader.assets, reloader.fromDisk, reloader.theme)
+	if err != nil {
+		l.Logf(l.ErrorMessage, "Unable to reload the templates, keeping the old ones: %v", err)
+		return
+	}
+	l.Log(l.InfoMessage, "Reloaded the changed templates.")
+}
+
+// Handler parses the templates again before a request if they've changed.
+func (reloader *assetsReloader) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reloader.reload()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseOverride parses the theme's template file into tmpl, if there is one.
+func parseOverride(tmpl *template.Template, theme fs.FS, file string) (*template.Template, error) {
+	found, err := themeHas(theme, file)
+	if err != nil || !found {
+		return tmpl, err
+	}
+	return tmpl.ParseFS(theme, "templates/"+file)
+}
+
+// themeHas reports whether the theme has the template file.
+func themeHas(theme fs.FS, file string) (bool, error) {
+	if theme == nil {
+		return false, nil
+	}
+	_, err := fs.Stat(theme, "templates/"+file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// A staticSet serves the files in a static directory.
+type staticSet struct {
+	files    fs.FS
+	fromDisk bool
+
+	// The content hash of each file, by name, and the
+	// name of each file, by hashed name.
+	hashes       map[string]string
+	byHashedName map[string]string
+}
+
+// newStaticSet serves the files in the static directory of assets.
+// A missing static directory serves no files.
+func newStaticSet(assets fs.FS, fromDisk bool) (*staticSet, error) {
+	set := &staticSet{fromDisk: fromDisk, hashes: map[string]string{}, byHashedName: map[string]string{}}
+	var err error
+	set.files, err = fs.Sub(assets, "static")
+	if err != nil {
+		return nil, err
+	}
+	err = fs.WalkDir(set.files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && name == "." {
+			return fs.SkipAll
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(set.files, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		set.hashes[name] = hex.EncodeToString(sum[:])[:staticHashLength]
+		set.byHashedName[hashedName(name, set.hashes[name])] = name
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to hash the static files: %v", err)
+	}
+	return set, nil
+}
+
+// hashedName adds the hash to the name, before the extension,
+// so "pure-min.css" becomes "pure-min.0123456789.css".
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// name returns the name to request a file by, which includes
+// the hash of its content if it can be cached for long.
+func (set *staticSet) name(name string) string {
+	hash, ok := set.hashes[name]
+	if !ok || set.fromDisk {
+		return name
+	}
+	return hashedName(name, hash)
+}
+
+// stylesheets returns the names of the CSS files at the top of the set.
+func (set *staticSet) stylesheets() []string {
+	names := []string{}
+	for name := range set.hashes {
+		if path.Ext(name) == ".css" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeHTTP serves the file named by the request path. A file requested
+// by its hashed name never changes, so it can be cached for a year.
+func (set *staticSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	cacheControl := "no-cache"
+	if original, ok := set.byHashedName[name]; ok && !set.fromDisk {
+		name = original
+		cacheControl = fmt.Sprintf("public, max-age=%d, immutable", staticMaxAge)
+	}
+
+	if !fs.ValidPath(name) {
+		fourOhFour(w, r)
+		return
+	}
+	file, err := set.files.Open(name)
+	if err != nil {
+		fourOhFour(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		fourOhFour(w, r)
+		return
+	}
+
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(file)
+		if err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Static File Error")
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+
+	w.Header().Set("Cache-Control", cacheControl)
+	if hash, ok := set.hashes[name]; ok && !set.fromDisk {
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// serveStatic serves the built in static files.
+func serveStatic(w http.ResponseWriter, r *http.Request) {
+	assetsMutex.RLock()
+	static := staticAssets
+	assetsMutex.RUnlock()
+	static.ServeHTTP(w, r)
+}
+
+// serveThemeStatic serves the theme's static files.
+func serveThemeStatic(w http.ResponseWriter, r *http.Request) {
+	assetsMutex.RLock()
+	themeStatic := themeAssets
+	assetsMutex.RUnlock()
+	if themeStatic == nil {
+		fourOhFour(w, r)
+		return
+	}
+	themeStatic.ServeHTTP(w, r)
+}
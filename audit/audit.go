@@ -0,0 +1,121 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package audit provides a tamper-evident log of security relevant events.
+// Each entry includes the hash of the entry before it, so changing or
+// removing an entry breaks the chain from that point on.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Event string
+
+const (
+	Login               Event = "login"
+	FailedLogin         Event = "failed-login"
+	AgreementChange     Event = "agreement-change"
+	TextChange          Event = "text-change"
+	TextCorrection      Event = "text-correction"
+	SignatureCorrection Event = "signature-correction"
+	OwnerChange         Event = "owner-change"
+	Signature           Event = "signature"
+	FileUpload          Event = "file-upload"
+	FileDownload        Event = "file-download"
+	SettingChange       Event = "setting-change"
+	ReminderChange      Event = "reminder-change"
+	ReminderOptOut      Event = "reminder-opt-out"
+)
+
+// GenesisHash is the previous hash of the first entry in the chain.
+var GenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// An Entry is one event in the audit log.
+type Entry struct {
+	ID        int64
+	Timestamp time.Time
+	Event     Event
+	Actor     string
+	Subject   string
+	Details   string
+	PrevHash  string
+	Hash      string
+}
+
+// NewEntry creates an entry which happened now. PrevHash and Hash
+// are set when the entry is appended to the chain.
+func NewEntry(event Event, actor, subject, details string) *Entry {
+	// The database stores timestamps to the microsecond, and the
+	// hash must survive the round trip.
+	return &Entry{Timestamp: time.Now().UTC().Truncate(time.Microsecond),
+		Event:   event,
+		Actor:   actor,
+		Subject: subject,
+		Details: details}
+}
+
+// ComputeHash returns the hex encoded SHA-256 of the entry's
+// contents and the hash of the previous entry.
+func (entry *Entry) ComputeHash() string {
+	// Free text fields are quoted so that no two different
+	// entries can produce the same input to the hash.
+	input := strings.Join([]string{
+		entry.PrevHash,
+		entry.Timestamp.UTC().Format(time.RFC3339Nano),
+		strconv.Quote(string(entry.Event)),
+		strconv.Quote(entry.Actor),
+		strconv.Quote(entry.Subject),
+		strconv.Quote(entry.Details),
+	}, "\n")
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:])
+}
+
+// Link sets the entry's PrevHash and Hash so it follows prevHash in the chain.
+func (entry *Entry) Link(prevHash string) {
+	entry.PrevHash = prevHash
+	entry.Hash = entry.ComputeHash()
+}
+
+// A BrokenLinkError describes the first entry at which the chain is broken.
+type BrokenLinkError struct {
+	Entry  *Entry
+	Reason string
+}
+
+func (e *BrokenLinkError) Error() string {
+	return fmt.Sprintf("Audit log entry %v (%v %v at %v) is broken: %v",
+		e.Entry.ID, e.Entry.Event, e.Entry.Subject, e.Entry.Timestamp.Format(time.RFC3339), e.Reason)
+}
+
+// A Verifier walks the chain, one entry at a time, oldest first.
+type Verifier struct {
+	prevHash string
+	Count    int
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{prevHash: GenesisHash}
+}
+
+// Check verifies the next entry in the chain, returning a
+// *BrokenLinkError if it doesn't follow the previous entry.
+func (v *Verifier) Check(entry *Entry) error {
+	if entry.PrevHash != v.prevHash {
+		return &BrokenLinkError{Entry: entry,
+			Reason: "the previous entry is missing, or was changed or reordered"}
+	}
+	if entry.ComputeHash() != entry.Hash {
+		return &BrokenLinkError{Entry: entry, Reason: "the entry was changed after it was recorded"}
+	}
+	v.prevHash = entry.Hash
+	v.Count++
+	return nil
+}
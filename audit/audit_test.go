@@ -0,0 +1,74 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"testing"
+)
+
+func testChain() []*Entry {
+	entries := []*Entry{
+		NewEntry(Login, "jsmith", "jsmith", "from 10.0.0.1"),
+		NewEntry(AgreementChange, "jsmith", "agreement 1", "title changed"),
+		NewEntry(Signature, "adoe", "agreement text 3", ""),
+	}
+	prevHash := GenesisHash
+	for i, entry := range entries {
+		entry.ID = int64(i + 1)
+		entry.Link(prevHash)
+		prevHash = entry.Hash
+	}
+	return entries
+}
+
+func verify(entries []*Entry) error {
+	verifier := NewVerifier()
+	for _, entry := range entries {
+		if err := verifier.Check(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestVerifyIntactChain(t *testing.T) {
+	if err := verify(testChain()); err != nil {
+		t.Errorf("Intact chain failed verification: %v", err)
+	}
+}
+
+func TestVerifyChangedEntry(t *testing.T) {
+	entries := testChain()
+	entries[1].Details = "nothing to see here"
+
+	err := verify(entries)
+	broken, ok := err.(*BrokenLinkError)
+	if !ok || broken.Entry.ID != 2 {
+		t.Errorf("Changed entry wasn't reported as the first broken link: %v", err)
+	}
+}
+
+func TestVerifyRemovedEntry(t *testing.T) {
+	entries := testChain()
+	entries = append(entries[:1], entries[2:]...)
+
+	err := verify(entries)
+	broken, ok := err.(*BrokenLinkError)
+	if !ok || broken.Entry.ID != 3 {
+		t.Errorf("Entry after a removed entry wasn't reported as the first broken link: %v", err)
+	}
+}
+
+func TestVerifyRehashedEntry(t *testing.T) {
+	entries := testChain()
+	entries[0].Actor = "mallory"
+	entries[0].Link(GenesisHash)
+
+	err := verify(entries)
+	broken, ok := err.(*BrokenLinkError)
+	if !ok || broken.Entry.ID != 2 {
+		t.Errorf("Rehashing a changed entry didn't break the next link: %v", err)
+	}
+}
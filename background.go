@@ -0,0 +1,47 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	l "github.com/cu-library/signtwo/loglevel"
+	"sync"
+	"time"
+)
+
+// Background jobs run until their context is cancelled at shutdown.
+var backgroundContext, cancelBackgroundJobs = context.WithCancel(context.Background())
+var backgroundJobs sync.WaitGroup
+
+// startBackgroundJob runs the job in its own goroutine. The job
+// should return soon after its context is cancelled.
+func startBackgroundJob(name string, job func(ctx context.Context)) {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		l.Logf(l.DebugMessage, "Background job %v started.", name)
+		job(backgroundContext)
+		l.Logf(l.DebugMessage, "Background job %v stopped.", name)
+	}()
+}
+
+// stopBackgroundJobs cancels the background jobs and waits for them to
+// return, for up to the timeout.
+func stopBackgroundJobs(timeout time.Duration) {
+	cancelBackgroundJobs()
+
+	stopped := make(chan struct{})
+	go func() {
+		backgroundJobs.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		l.Log(l.InfoMessage, "Background jobs stopped.")
+	case <-time.After(timeout):
+		l.Log(l.WarnMessage, "Background jobs didn't stop before the shutdown timeout.")
+	}
+}
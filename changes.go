@@ -0,0 +1,135 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"github.com/cu-library/signtwo/db"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/cu-library/signtwo/worddiff"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// changesHandler shows the changes between two versions in an agreement
+// text's replacement chain, side by side. The ?from= and ?to= query
+// parameters are text IDs. By default, the current text is compared with
+// the version the user signed, or else with the text it replaced. Texts
+// which haven't been enacted yet are only shown to owners.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Changes Handler visited.")
+
+	agreement, ok := loadAgreement(w, r)
+	if !ok {
+		return
+	}
+	username, loggedIn := sessionUsername(r)
+	if !agreement.Enabled && !requireOwner(w, r, agreement.ID) {
+		return
+	}
+
+	var to *db.AgreementText
+	var err error
+	if toID, ok := queryID(r, "to"); ok {
+		to, err = db.GetAgreementText(toID)
+	} else {
+		to, err = db.CurrentAgreementText(agreement.ID)
+	}
+	if err == sql.ErrNoRows || (err == nil && to.BaseAgreementID != agreement.ID) {
+		fourOhFour(w, r)
+		return
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load a text of agreement %v: %v", agreement.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	chain, err := db.ReplacementChain(to)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the replacement chain of agreement text %v: %v", to.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	position := map[int64]int{}
+	for i, text := range chain {
+		position[text.ID] = i
+	}
+
+	var from *db.AgreementText
+	sinceSigned := false
+	if fromID, ok := queryID(r, "from"); ok {
+		i, inChain := position[fromID]
+		if !inChain {
+			fourOhFour(w, r)
+			return
+		}
+		from = chain[i]
+	} else if position[to.ID] > 0 {
+		from = chain[position[to.ID]-1]
+	}
+	if loggedIn {
+		signature, err := db.LatestUserSignature(username, agreement.ID)
+		if err != nil && err != sql.ErrNoRows {
+			logFor(r).Logf(l.ErrorMessage, "Unable to load the signature of %v on agreement %v: %v", username, agreement.ID, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database Error")
+			return
+		}
+		if signature != nil {
+			i, inChain := position[signature.SignedAgreementTextID]
+			if _, chosen := queryID(r, "from"); !chosen && inChain && i < position[to.ID] {
+				from = chain[i]
+			}
+			sinceSigned = from != nil && from.ID == signature.SignedAgreementTextID
+		}
+	}
+
+	// Drafts are only shown to the agreement's owners.
+	for _, text := range []*db.AgreementText{from, to} {
+		if text != nil && text.EnactmentDate.After(time.Now()) && !requireOwner(w, r, agreement.ID) {
+			return
+		}
+	}
+
+	data := map[string]interface{}{
+		"agreement":   agreement,
+		"chain":       chain,
+		"to":          to,
+		"from":        from,
+		"sinceSigned": sinceSigned,
+	}
+	if from != nil {
+		// Compare the versions in the user's language, where they've been translated.
+		language := languageFor(r)
+		shownFrom, err := db.TextInLanguage(from, language)
+		if err == nil {
+			var shownTo *db.AgreementText
+			shownTo, err = db.TextInLanguage(to, language)
+			if err == nil {
+				content := worddiff.Diff(shownFrom.Content, shownTo.Content)
+				data["content"] = content
+				data["changed"] = worddiff.Changed(content) || shownFrom.Title != shownTo.Title
+				if shownFrom.Title != shownTo.Title {
+					data["title"] = worddiff.Diff(shownFrom.Title.String, shownTo.Title.String)
+				}
+			}
+		}
+		if err != nil {
+			logFor(r).Logf(l.ErrorMessage, "Unable to load the translations of agreement texts %v and %v: %v", from.ID, to.ID, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database Error")
+			return
+		}
+	}
+
+	renderTemplateOr500(w, r, changesTemplate, data)
+}
+
+// queryID parses a text ID from the query string. The second return
+// value is false if the parameter is missing or isn't an ID.
+func queryID(r *http.Request, name string) (int64, bool) {
+	id, err := strconv.ParseInt(r.URL.Query().Get(name), 10, 64)
+	return id, err == nil && id > 0
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cu-library/signtwo/audit"
+	"github.com/cu-library/signtwo/db"
+	"github.com/cu-library/signtwo/keyring"
+	"os"
+	"strings"
+	"time"
+)
+
+// A command is run from the command line instead of the server,
+// for example: signtwo audit verify
+type command struct {
+	name        string
+	description string
+	run         func() int
+}
+
+var commands = []command{
+	{"audit verify", "Walk the audit log's hash chain and report the first broken link.", auditVerifyCommand},
+	{"config", "Print the effective configuration, with secrets masked.", configCommand},
+	{"gen-secret", "Generate a new key for the -secret keyring.", genSecretCommand},
+}
+
+// runCommand runs the command named by args, returning the exit code.
+func runCommand(args []string) int {
+	name := strings.Join(args, " ")
+	for _, command := range commands {
+		if command.name == name {
+			return command.run()
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command '%v'.\n", name)
+	return 2
+}
+
+func auditVerifyCommand() int {
+	if *databaseURL == "" {
+		fmt.Fprintln(os.Stderr, "A database url is required.")
+		return 2
+	}
+	err := db.Connect(*databaseURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not connect to a database using the provided database url: %v\n", err)
+		return 2
+	}
+	defer db.Close()
+
+	verifier := audit.NewVerifier()
+	err = db.EachAuditEntry(verifier.Check)
+	if broken, ok := err.(*audit.BrokenLinkError); ok {
+		fmt.Printf("BROKEN: %v\n", broken)
+		fmt.Printf("The %v entries before it are intact.\n", verifier.Count)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read the audit log: %v\n", err)
+		return 2
+	}
+
+	fmt.Printf("OK: The audit log's %v entries are intact.\n", verifier.Count)
+	return 0
+}
+
+// configCommand prints every option after the configuration file and
+// environment are applied, and where each value came from.
+func configCommand() int {
+	printEffectiveConfiguration(os.Stdout)
+	return 0
+}
+
+func genSecretCommand() int {
+	key, err := keyring.Generate(time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to generate a key: %v\n", err)
+		return 2
+	}
+
+	fmt.Println(key)
+	fmt.Fprintf(os.Stderr, "\nTo rotate keys, add this key to the front of -secret, and give the key it replaces\n"+
+		"a retirement date at least %v away, for example:\n"+
+		"  -secret \"<new key>,<old key>@%v\"\n",
+		DefaultSessionLength, time.Now().Add(DefaultSessionLength+24*time.Hour).Format(keyring.DateLayout))
+	return 0
+}
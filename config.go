@@ -0,0 +1,237 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The configuration file is a layer between the defaults and the
+// environment variables. Each key in a section sets a flag:
+// Default < Configuration file < Environment variable < Command line option
+var configKeys = map[string]string{
+	"server.address":         "address",
+	"server.basepath":        "basepath",
+	"server.assetsdir":       "assetsdir",
+	"server.themedir":        "themedir",
+	"server.shutdowntimeout": "shutdowntimeout",
+	"server.tlscert":         "tlscert",
+	"server.tlskey":          "tlskey",
+	"server.httpredirect":    "httpredirect",
+	"server.trustedproxies":  "trustedproxies",
+	"server.operators":       "operators",
+	"log.level":              "loglevel",
+	"log.format":             "logformat",
+	"log.components":         "loglevels",
+	"log.sinks":              "logsinks",
+	"log.access":             "accesslog",
+	"log.accessformat":       "accesslogformat",
+	"database.url":           "dburl",
+	"ldap.server":            "ldapserver",
+	"ldap.port":              "ldapport",
+	"ldap.user":              "ldapuser",
+	"ldap.password":          "ldappass",
+	"ldap.basedn":            "ldapbasedn",
+	"mail.smtpserver":        "smtpserver",
+	"mail.smtpuser":          "smtpuser",
+	"mail.smtppass":          "smtppass",
+	"mail.from":              "mailfrom",
+	"mail.siteurl":           "siteurl",
+	"secrets.secret":         "secret",
+	"secrets.receiptkey":     "receiptkey",
+	"secrets.metricstoken":   "metricstoken",
+}
+
+// Flags whose values are masked when the configuration is printed.
+var secretFlags = map[string]bool{
+	"ldappass":     true,
+	"secret":       true,
+	"receiptkey":   true,
+	"smtppass":     true,
+	"metricstoken": true,
+}
+
+// Where each flag's value came from, if not the default.
+var flagSources = map[string]string{}
+
+// A configError is a problem at a line of the configuration file.
+type configError struct {
+	file    string
+	line    int
+	message string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%v:%v: %v", e.file, e.line, e.message)
+}
+
+// loadConfigFile sets the flags named by the keys of the configuration
+// file, except for flags set on the command line or by an environment
+// variable. Every problem in the file is returned, not just the first.
+func loadConfigFile(path string) []error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("Unable to read configuration file: %v", err)}
+	}
+
+	var document yaml.Node
+	err = yaml.Unmarshal(contents, &document)
+	if err != nil {
+		return []error{fmt.Errorf("%v: %v", path, err)}
+	}
+	if len(document.Content) == 0 {
+		return nil
+	}
+
+	// Flags which a higher layer has already set.
+	setByHigherLayer := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setByHigherLayer[f.Name] = true })
+	for name, source := range flagSources {
+		if source != "" {
+			setByHigherLayer[name] = true
+		}
+	}
+
+	var errs []error
+	var walk func(prefix string, node *yaml.Node)
+	walk = func(prefix string, node *yaml.Node) {
+		if node.Kind != yaml.MappingNode {
+			errs = append(errs, &configError{path, node.Line, "expected a section of keys"})
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+			key := prefix + keyNode.Value
+
+			if valueNode.Kind == yaml.MappingNode {
+				if !isConfigSection(key) {
+					errs = append(errs, &configError{path, keyNode.Line, fmt.Sprintf("unknown section '%v'", key)})
+					continue
+				}
+				walk(key+".", valueNode)
+				continue
+			}
+
+			flagName, ok := configKeys[key]
+			if !ok {
+				message := fmt.Sprintf("unknown key '%v'", key)
+				if isConfigSection(key) {
+					message = fmt.Sprintf("'%v' is a section, expected keys beneath it", key)
+				}
+				errs = append(errs, &configError{path, keyNode.Line, message})
+				continue
+			}
+			if valueNode.Kind != yaml.ScalarNode {
+				errs = append(errs, &configError{path, valueNode.Line, fmt.Sprintf("expected a single value for '%v'", key)})
+				continue
+			}
+			if setByHigherLayer[flagName] {
+				continue
+			}
+
+			err := flag.Lookup(flagName).Value.Set(valueNode.Value)
+			if err != nil {
+				errs = append(errs, &configError{path, valueNode.Line,
+					fmt.Sprintf("invalid value \"%v\" for '%v': %v", valueNode.Value, key, err)})
+				continue
+			}
+			flagSources[flagName] = fmt.Sprintf("%v:%v", path, valueNode.Line)
+		}
+	}
+	walk("", document.Content[0])
+	return errs
+}
+
+// isConfigSection reports whether name is a section of the configuration file.
+func isConfigSection(name string) bool {
+	for key := range configKeys {
+		if strings.HasPrefix(key, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// settleConfiguration applies the environment variables and configuration
+// file to the flags which weren't set on the command line.
+func settleConfiguration() []error {
+	// If there are any environment variables, they
+	// are used to set flags which were not passed in
+	// as a command line option.
+	overrideUnsetFlagsFromEnvironmentVariables()
+	err := loadSecretFiles()
+	if err != nil {
+		return []error{err}
+	}
+
+	flag.Visit(func(f *flag.Flag) { flagSources[f.Name] = "command line" })
+
+	if *configPath == "" {
+		return nil
+	}
+	return loadConfigFile(*configPath)
+}
+
+// maskedValue returns the flag's value with any secrets masked.
+func maskedValue(f *flag.Flag) string {
+	value := f.Value.String()
+	if value == "" {
+		return value
+	}
+	if secretFlags[f.Name] {
+		return "********"
+	}
+	// Mask the password inside a database url.
+	if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+		return parsed.Redacted()
+	}
+	return value
+}
+
+// printConfigKeys writes every key of the configuration file, with the
+// flag it sets and the flag's default.
+func printConfigKeys(w io.Writer) {
+	var lines []string
+	for key, flagName := range configKeys {
+		lines = append(lines, fmt.Sprintf("  %-20v -%-14v %q", key, flagName, flag.Lookup(flagName).DefValue))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// printEffectiveConfiguration writes every flag's value after all the layers
+// are applied, and where the value came from.
+func printEffectiveConfiguration(w io.Writer) {
+	keysByFlag := make(map[string]string)
+	for key, flagName := range configKeys {
+		keysByFlag[flagName] = key
+	}
+
+	var lines []string
+	flag.VisitAll(func(f *flag.Flag) {
+		source := flagSources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		key := keysByFlag[f.Name]
+		if key == "" {
+			key = "-"
+		}
+		lines = append(lines, fmt.Sprintf("  %-14v %-20v %-40q (%v)", f.Name, key, maskedValue(f), source))
+	})
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/cu-library/signtwo/db"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/cu-library/signtwo/markdown"
+	"html/template"
+	"net/http"
+)
+
+// The largest draft accepted for previewing.
+const maxPreviewSize = 1 << 20
+
+// The rendered HTML of recently shown agreement texts, keyed by the
+// hash of their content, so each version of a text is rendered once.
+var renderedTexts = markdown.NewCache(DefaultRenderCacheSize)
+
+// textHTML returns the agreement text's content as HTML. Markdown is
+// rendered and sanitized, and plain text is shown preformatted.
+func textHTML(text *db.AgreementText) template.HTML {
+	if text.Format == db.PlainText {
+		return template.HTML("<pre>" + template.HTMLEscapeString(text.Content) + "</pre>")
+	}
+	return renderedTexts.Render(db.ContentHash(text.Content), text.Content)
+}
+
+// previewPOSTHandler renders a draft of Markdown content for the
+// preview in the text editor. Drafts aren't cached.
+func previewPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Preview POST Handler visited.")
+
+	if _, ok := requireLogin(w, r); !ok {
+		return
+	}
+
+	content := r.PostFormValue("content")
+	if len(content) > maxPreviewSize {
+		errorPage(w, r, http.StatusRequestEntityTooLarge, "The draft is too large to preview.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(markdown.Render(content)))
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"database/sql"
+	"github.com/cu-library/signtwo/audit"
+)
+
+// AppendAuditEntry links the entry to the end of the audit log chain and stores it.
+func AppendAuditEntry(entry *audit.Entry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Only one entry can be appended at a time, or two entries
+	// could both link to the same previous entry.
+	_, err = tx.Exec("LOCK TABLE audit_log IN EXCLUSIVE MODE;")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	prevHash := audit.GenesisHash
+	err = tx.QueryRow("SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1;").Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	entry.Link(prevHash)
+
+	err = tx.QueryRow("INSERT INTO audit_log(timestamp,event,actor,subject,details,prev_hash,hash) "+
+		"VALUES($1,$2,$3,$4,$5,$6,$7) "+
+		"RETURNING id;",
+		entry.Timestamp,
+		string(entry.Event),
+		entry.Actor,
+		entry.Subject,
+		entry.Details,
+		entry.PrevHash,
+		entry.Hash).Scan(&entry.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// EachAuditEntry calls fn with each entry of the audit log, oldest first,
+// stopping at the first error.
+func EachAuditEntry(fn func(*audit.Entry) error) error {
+	rows, err := db.Query("SELECT id, timestamp, event, actor, subject, details, prev_hash, hash " +
+		"FROM audit_log " +
+		"ORDER BY id;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := new(audit.Entry)
+		var event string
+		err := rows.Scan(&entry.ID,
+			&entry.Timestamp,
+			&event,
+			&entry.Actor,
+			&entry.Subject,
+			&entry.Details,
+			&entry.PrevHash,
+			&entry.Hash)
+		if err != nil {
+			return err
+		}
+		entry.Event = audit.Event(event)
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
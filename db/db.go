@@ -7,24 +7,70 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	_ "github.com/lib/pq"
+	"database/sql/driver"
+	"github.com/lib/pq"
 	"errors"
 	l "github.com/cu-library/signtwo/loglevel"
+	"sync"
 )
 
 var db *sql.DB
 
+// The package's messages use the db component's log level.
+var logger = l.For(l.DB)
+
+// The connector opens each new connection with the current database url,
+// so a changed password can be picked up without replacing db.
+var connector = new(urlConnector)
+
+type urlConnector struct {
+	mutex sync.RWMutex
+	url   string
+}
+
+func (c *urlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mutex.RLock()
+	url := c.url
+	c.mutex.RUnlock()
+
+	pqConnector, err := pq.NewConnector(url)
+	if err != nil {
+		return nil, err
+	}
+	return pqConnector.Connect(ctx)
+}
+
+func (c *urlConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// Use makes the package use the database instead of connecting with
+// Connect, so tests can use a database/sql driver of their own.
+func Use(database *sql.DB) {
+	db = database
+}
+
+// SetURL changes the database url used by connections opened from now on.
+// Existing connections are not closed.
+func SetURL(databaseURL string) {
+	connector.mutex.Lock()
+	defer connector.mutex.Unlock()
+	connector.url = databaseURL
+}
+
 func Connect(databaseURL string) error {
 
-	l.Log(l.InfoMessage, "Connecting to database...")
+	logger.Log(l.InfoMessage, "Connecting to database...")
 
-	// This err ensures the db variable refers to the global one
-	var err error
-	db, err = sql.Open("postgres", databaseURL)
+	// Check the url is valid now, rather than on the first connection.
+	_, err := pq.NewConnector(databaseURL)
 	if err != nil {
 		return err
 	}
+	SetURL(databaseURL)
+	db = sql.OpenDB(connector)
 
 	// Can we access the database?
 	err = db.Ping()
@@ -43,7 +89,11 @@ func Connect(databaseURL string) error {
     defer rows.Close()
 
     // Go doesn't have sets, per se. Fake with map.
-    requiredTables := map[string]bool{"agreement":true, "owner":true, "agreement_text":true, "signature":true}
+    requiredTables := map[string]bool{"agreement":true, "owner":true, "agreement_text":true, "signature":true,
+                                      "correction":true, "audit_log":true, "receipt":true, "receipt_key":true,
+                                      "agreement_text_translation":true, "reminder_campaign":true,
+                                      "reminder":true, "reminder_opt_out":true,
+                                      "reminder_outcome":true}
 
     for rows.Next() {
     	var tableName string
@@ -51,7 +101,7 @@ func Connect(databaseURL string) error {
 		if err != nil {
 			return err
 		}
-		l.Logf(l.TraceMessage, "Found table %v", tableName)
+		logger.Logf(l.TraceMessage, "Found table %v", tableName)
 		delete(requiredTables, tableName)	
 	}
 
@@ -60,16 +110,58 @@ func Connect(databaseURL string) error {
 			              "please check the database creation documentation.")
 	}
 
-	l.Log(l.InfoMessage, "Successful database connection.")
+	logger.Log(l.InfoMessage, "Successful database connection.")
 	return nil	
 }
 
+// Ping checks that the database can be reached.
+func Ping(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
+
+// Stats returns the connection pool statistics.
+func Stats() sql.DBStats {
+	if db == nil {
+		return sql.DBStats{}
+	}
+	return db.Stats()
+}
+
 func Close() {
-	l.Log(l.TraceMessage, "Closing database connection...")
+	logger.Log(l.TraceMessage, "Closing database connection...")
 	db.Close()
-	l.Log(l.TraceMessage, "Successfully closed database connection.")
+	logger.Log(l.TraceMessage, "Successfully closed database connection.")
+}
+
+// ErrConflict is returned by Store when the row was changed by someone
+// else after it was loaded. The caller should reload the row and let
+// the user reapply their edit.
+var ErrConflict = errors.New("The row was changed after it was loaded.")
+
+// ErrImmutable is returned when trying to change a signature or an
+// agreement text which has been signed. Record a Correction instead.
+var ErrImmutable = errors.New("Signatures and signed agreement texts can not be changed.")
+
+// ErrContentChanged is returned when storing a signature whose content
+// hash doesn't match the agreement text's content as stored.
+var ErrContentChanged = errors.New("The signed content has changed since it was shown.")
+
+// The SQLSTATE raised by the database triggers which protect signed rows.
+const restrictViolation = "23001"
+
+// immutableError maps errors raised by the database triggers
+// which protect signed rows to ErrImmutable.
+func immutableError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == restrictViolation {
+		return ErrImmutable
+	}
+	return err
 }
 
+// Store saves the agreement. A zero ID inserts a new agreement,
+// otherwise the existing agreement is updated if its version in the
+// database still matches agreement.Version. On success, the ID and
+// Version fields are updated to match the stored row.
 func (agreement *Agreement) Store() (int64, error) {
 
 	// Can we access the database?
@@ -84,31 +176,36 @@ func (agreement *Agreement) Store() (int64, error) {
 		return 0, err
 	}
 
-	var returnedAgreementID int64
+	var returnedAgreementID, returnedVersion int64
 
 	if agreement.ID == 0 {
 		// Create a new agreement from a zero'd struct
 		err = tx.QueryRow("INSERT INTO agreement(title,description,created,enabled) "+
 			"VALUES($1,$2,$3,$4) "+
-			"RETURNING id;",
+			"RETURNING id, version;",
 			agreement.Title,
 			agreement.Description,
 			agreement.Created,
-			agreement.Enabled).Scan(&returnedAgreementID)
+			agreement.Enabled).Scan(&returnedAgreementID, &returnedVersion)
 	} else {
-		// Update an existing agreement
+		// Update an existing agreement, only if nobody else has since.
 		err = tx.QueryRow("UPDATE agreement "+
-			"SET title = $1, description = $2, created = $3, enabled = $4 "+
-			"WHERE id  = $5 "+
-			"RETURNING id;",
+			"SET title = $1, description = $2, created = $3, enabled = $4, version = version + 1 "+
+			"WHERE id  = $5 AND version = $6 "+
+			"RETURNING id, version;",
 			agreement.Title,
 			agreement.Description,
 			agreement.Created,
 			agreement.Enabled,
-			agreement.ID).Scan(&returnedAgreementID)
+			agreement.ID,
+			agreement.Version).Scan(&returnedAgreementID, &returnedVersion)
+		if err == sql.ErrNoRows {
+			err = ErrConflict
+		}
 	}
 
 	if err != nil {
+		tx.Rollback()
 		return 0, err
 	}
 
@@ -118,5 +215,286 @@ func (agreement *Agreement) Store() (int64, error) {
 		return 0, err
 	}
 
+	agreement.ID = returnedAgreementID
+	agreement.Version = returnedVersion
 	return returnedAgreementID, nil
 }
+
+// Store saves the agreement text. A zero ID inserts a new text,
+// otherwise the existing text is updated if its version in the
+// database still matches text.Version. On success, the ID and
+// Version fields are updated to match the stored row.
+func (text *AgreementText) Store() (int64, error) {
+
+	// Can we access the database?
+	err := db.Ping()
+	if err != nil {
+		return 0, err
+	}
+
+	// Begin a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var returnedTextID, returnedVersion int64
+
+	if text.ID == 0 {
+		err = tx.QueryRow("INSERT INTO agreement_text(base_agreement_id,title,content,created,"+
+			"enactment_date,replaces_agreement_text_id,language,format) "+
+			"VALUES($1,$2,$3,$4,$5,NULLIF($6,0),COALESCE(NULLIF($7,''),'en'),COALESCE(NULLIF($8,''),'markdown')) "+
+			"RETURNING id, version;",
+			text.BaseAgreementID,
+			text.Title,
+			text.Content,
+			text.Created,
+			text.EnactmentDate,
+			text.ReplacesAgreementTextID,
+			text.Language,
+			string(text.Format)).Scan(&returnedTextID, &returnedVersion)
+	} else {
+		// Signed texts are also protected by a trigger, but checking
+		// first gives a clearer error than a conflict.
+		var signed bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM signature "+
+			"WHERE signed_agreement_text_id = $1);", text.ID).Scan(&signed)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if signed {
+			tx.Rollback()
+			return 0, ErrImmutable
+		}
+
+		err = tx.QueryRow("UPDATE agreement_text "+
+			"SET title = $1, content = $2, enactment_date = $3, "+
+			"replaces_agreement_text_id = NULLIF($4,0), language = COALESCE(NULLIF($7,''),language), "+
+			"format = COALESCE(NULLIF($8,''),format), "+
+			"version = version + 1 "+
+			"WHERE id = $5 AND version = $6 "+
+			"RETURNING id, version;",
+			text.Title,
+			text.Content,
+			text.EnactmentDate,
+			text.ReplacesAgreementTextID,
+			text.ID,
+			text.Version,
+			text.Language,
+			string(text.Format)).Scan(&returnedTextID, &returnedVersion)
+		if err == sql.ErrNoRows {
+			err = ErrConflict
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return 0, immutableError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, immutableError(err)
+	}
+
+	text.ID = returnedTextID
+	text.Version = returnedVersion
+	return returnedTextID, nil
+}
+
+// GetAgreement loads the agreement with the given ID.
+func GetAgreement(id int64) (*Agreement, error) {
+	agreement := new(Agreement)
+	err := db.QueryRow("SELECT id, title, description, created, enabled, version "+
+		"FROM agreement "+
+		"WHERE id = $1;", id).Scan(
+		&agreement.ID,
+		&agreement.Title,
+		&agreement.Description,
+		&agreement.Created,
+		&agreement.Enabled,
+		&agreement.Version)
+	if err != nil {
+		return nil, err
+	}
+	return agreement, nil
+}
+
+// AgreementsOwnedBy returns the agreements the user is an owner of.
+func AgreementsOwnedBy(username string) ([]*Agreement, error) {
+	rows, err := db.Query("SELECT a.id, a.title, a.description, a.created, a.enabled, a.version "+
+		"FROM agreement a JOIN owner o ON o.owns_agreement_id = a.id "+
+		"WHERE o.username = $1 "+
+		"ORDER BY a.title;", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	agreements := []*Agreement{}
+	for rows.Next() {
+		agreement := new(Agreement)
+		err := rows.Scan(&agreement.ID,
+			&agreement.Title,
+			&agreement.Description,
+			&agreement.Created,
+			&agreement.Enabled,
+			&agreement.Version)
+		if err != nil {
+			return nil, err
+		}
+		agreements = append(agreements, agreement)
+	}
+	return agreements, rows.Err()
+}
+
+// IsOwner reports whether the user is an owner of the agreement.
+func IsOwner(agreementID int64, username string) (bool, error) {
+	var isOwner bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM owner "+
+		"WHERE owns_agreement_id = $1 AND username = $2);",
+		agreementID, username).Scan(&isOwner)
+	return isOwner, err
+}
+
+// GetOwner returns the user's ownership of the agreement.
+func GetOwner(agreementID int64, username string) (*Owner, error) {
+	owner := new(Owner)
+	err := db.QueryRow("SELECT id, owns_agreement_id, username, notify_signatures "+
+		"FROM owner "+
+		"WHERE owns_agreement_id = $1 AND username = $2;", agreementID, username).Scan(
+		&owner.ID,
+		&owner.OwnsAgreementID,
+		&owner.Username,
+		&owner.NotifySignatures)
+	if err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+// SetNotifySignatures sets whether the owner is emailed when someone signs the agreement.
+func (owner *Owner) SetNotifySignatures(notify bool) error {
+	_, err := db.Exec("UPDATE owner SET notify_signatures = $1 WHERE id = $2;", notify, owner.ID)
+	if err != nil {
+		return err
+	}
+	owner.NotifySignatures = notify
+	return nil
+}
+
+// NotifiedOwners returns the usernames of the agreement's owners
+// who are emailed when someone signs it.
+func NotifiedOwners(agreementID int64) ([]string, error) {
+	rows, err := db.Query("SELECT username FROM owner "+
+		"WHERE owns_agreement_id = $1 AND notify_signatures "+
+		"ORDER BY username;", agreementID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		err := rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+const selectAgreementText = "SELECT id, base_agreement_id, title, content, created, enactment_date, " +
+	"COALESCE(replaces_agreement_text_id, 0), version, language, format " +
+	"FROM agreement_text "
+
+func scanAgreementText(row interface {
+	Scan(dest ...interface{}) error
+}) (*AgreementText, error) {
+	text := new(AgreementText)
+	var format string
+	err := row.Scan(&text.ID,
+		&text.BaseAgreementID,
+		&text.Title,
+		&text.Content,
+		&text.Created,
+		&text.EnactmentDate,
+		&text.ReplacesAgreementTextID,
+		&text.Version,
+		&text.Language,
+		&format)
+	if err != nil {
+		return nil, err
+	}
+	text.Format = TextFormat(format)
+	return text, nil
+}
+
+// CurrentAgreementText returns the most recently enacted text of the agreement.
+// It returns sql.ErrNoRows if no text has been enacted yet.
+func CurrentAgreementText(agreementID int64) (*AgreementText, error) {
+	return scanAgreementText(db.QueryRow(selectAgreementText+
+		"WHERE base_agreement_id = $1 AND enactment_date <= now() "+
+		"ORDER BY enactment_date DESC, id DESC "+
+		"LIMIT 1;", agreementID))
+}
+
+// GetAgreementText loads the agreement text with the given ID.
+func GetAgreementText(id int64) (*AgreementText, error) {
+	return scanAgreementText(db.QueryRow(selectAgreementText+"WHERE id = $1;", id))
+}
+
+// ReplacementChain returns the texts which the agreement text replaced,
+// the text itself, and the texts which replaced it, oldest first. When a
+// text was replaced more than once, the chain follows the newest replacement.
+func ReplacementChain(text *AgreementText) ([]*AgreementText, error) {
+	texts, err := AgreementTexts(text.BaseAgreementID)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[int64]*AgreementText{}
+	replacedBy := map[int64]*AgreementText{}
+	for _, t := range texts {
+		byID[t.ID] = t
+		// The texts are oldest first, so the newest replacement wins.
+		if t.ReplacesAgreementTextID != 0 {
+			replacedBy[t.ReplacesAgreementTextID] = t
+		}
+	}
+
+	chain := []*AgreementText{text}
+	seen := map[int64]bool{text.ID: true}
+	for previous := byID[text.ReplacesAgreementTextID]; previous != nil && !seen[previous.ID]; previous = byID[previous.ReplacesAgreementTextID] {
+		chain = append([]*AgreementText{previous}, chain...)
+		seen[previous.ID] = true
+	}
+	for next := replacedBy[text.ID]; next != nil && !seen[next.ID]; next = replacedBy[next.ID] {
+		chain = append(chain, next)
+		seen[next.ID] = true
+	}
+	return chain, nil
+}
+
+// AgreementTexts returns all the texts of an agreement, oldest first.
+func AgreementTexts(agreementID int64) ([]*AgreementText, error) {
+	rows, err := db.Query(selectAgreementText+
+		"WHERE base_agreement_id = $1 "+
+		"ORDER BY created, id;", agreementID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	texts := []*AgreementText{}
+	for rows.Next() {
+		text, err := scanAgreementText(rows)
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, text)
+	}
+	return texts, rows.Err()
+}
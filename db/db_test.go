@@ -0,0 +1,46 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestImmutableError(t *testing.T) {
+
+	triggerErr := &pq.Error{Code: restrictViolation, Message: "signature rows are immutable"}
+	if immutableError(triggerErr) != ErrImmutable {
+		t.Error("Trigger errors weren't mapped to ErrImmutable.")
+	}
+
+	otherPqErr := &pq.Error{Code: "23505", Message: "duplicate key value"}
+	if immutableError(otherPqErr) != otherPqErr {
+		t.Error("Other database errors were changed.")
+	}
+
+	otherErr := errors.New("connection refused")
+	if immutableError(otherErr) != otherErr {
+		t.Error("Other errors were changed.")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+
+	// The output of: printf 'I agree.\n' | sha256sum
+	expected := "032ed06f72820f02e8430f9922a9a82141a3a228ff64f355b6d0e32d547272b8"
+	if hash := ContentHash("I agree.\n"); hash != expected {
+		t.Errorf("Content hash was %v, expected %v", hash, expected)
+	}
+	if ContentHash("I agree.") == expected {
+		t.Error("Content hash ignored a change in the content.")
+	}
+
+	unhashed := &HashCheck{Signature: &Signature{}, CurrentSHA256: ContentHash("")}
+	if unhashed.Verifiable() || unhashed.Matches() {
+		t.Error("A signature without a recorded hash was verified.")
+	}
+}
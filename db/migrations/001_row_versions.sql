@@ -0,0 +1,7 @@
+-- Adds row versions used for optimistic concurrency control.
+-- Store() only updates a row if its version matches the one that was loaded.
+
+SET search_path TO webapp;
+
+ALTER TABLE agreement ADD COLUMN version bigint NOT NULL DEFAULT 1;
+ALTER TABLE agreement_text ADD COLUMN version bigint NOT NULL DEFAULT 1;
@@ -0,0 +1,51 @@
+-- Makes signatures, and agreement texts which have been signed, immutable.
+-- Changes are recorded as append-only corrections instead.
+
+SET search_path TO webapp;
+
+-- Corrections are the only way to amend a signature or a signed text.
+-- Each one records what changed, who made the change, and why.
+CREATE TABLE correction (
+    id                bigserial   PRIMARY KEY,
+    signature_id      bigint      REFERENCES signature (id),
+    agreement_text_id bigint      REFERENCES agreement_text (id),
+    field             text        NOT NULL,
+    old_value         text        NOT NULL,
+    new_value         text        NOT NULL,
+    corrected_by      text        NOT NULL,
+    reason            text        NOT NULL,
+    created           timestamptz NOT NULL DEFAULT now(),
+    CHECK ((signature_id IS NULL) <> (agreement_text_id IS NULL))
+);
+
+-- Signatures and corrections are append-only.
+-- The restrict_violation error code is mapped to db.ErrImmutable.
+CREATE FUNCTION reject_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION '% rows are immutable, record a correction instead', TG_TABLE_NAME
+        USING ERRCODE = 'restrict_violation';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER signature_immutable BEFORE UPDATE OR DELETE ON signature
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+CREATE TRIGGER correction_immutable BEFORE UPDATE OR DELETE ON correction
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+-- Once an agreement text has been signed, it can't be changed or removed.
+CREATE FUNCTION reject_signed_text_change() RETURNS trigger AS $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM signature WHERE signed_agreement_text_id = OLD.id) THEN
+        RAISE EXCEPTION 'agreement text % has been signed and is immutable', OLD.id
+            USING ERRCODE = 'restrict_violation';
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER agreement_text_immutable_when_signed BEFORE UPDATE OR DELETE ON agreement_text
+    FOR EACH ROW EXECUTE PROCEDURE reject_signed_text_change();
@@ -0,0 +1,8 @@
+-- Records the SHA-256 of the exact agreement text content each signer agreed to.
+-- Signatures made before this migration are left without a hash: hashing
+-- their text as it is now would certify content which may already have
+-- changed since they signed, so they're shown as unverifiable instead.
+
+SET search_path TO webapp;
+
+ALTER TABLE signature ADD COLUMN content_sha256 char(64);
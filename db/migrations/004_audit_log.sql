@@ -0,0 +1,22 @@
+-- Adds the append-only, hash-chained audit log.
+
+SET search_path TO webapp;
+
+-- The tamper-evident audit log. Each entry's hash covers the hash of
+-- the entry before it, see the audit package.
+CREATE TABLE audit_log (
+    id        bigserial   PRIMARY KEY,
+    timestamp timestamptz NOT NULL,
+    event     text        NOT NULL,
+    actor     text        NOT NULL,
+    subject   text        NOT NULL,
+    details   text        NOT NULL,
+    prev_hash char(64)    NOT NULL UNIQUE,
+    hash      char(64)    NOT NULL UNIQUE
+);
+
+CREATE TRIGGER audit_log_immutable BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE PROCEDURE reject_change();
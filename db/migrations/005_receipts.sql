@@ -0,0 +1,14 @@
+-- Adds signed PDF receipts of signatures.
+
+SET search_path TO webapp;
+
+-- The PDF receipt of each signature, and its detached Ed25519 signature.
+CREATE TABLE receipt (
+    signature_id      bigint      PRIMARY KEY REFERENCES signature (id),
+    pdf               bytea       NOT NULL,
+    ed25519_signature bytea       NOT NULL,
+    created           timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER receipt_immutable BEFORE UPDATE OR DELETE ON receipt
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
@@ -0,0 +1,43 @@
+-- Adds translations of agreement texts, and records the language
+-- of the version each signer read. Existing texts and signatures
+-- are in English.
+
+SET search_path TO webapp;
+
+ALTER TABLE agreement_text ADD COLUMN language text NOT NULL DEFAULT 'en';
+
+ALTER TABLE signature DISABLE TRIGGER signature_immutable;
+ALTER TABLE signature ADD COLUMN language text NOT NULL DEFAULT 'en';
+ALTER TABLE signature ENABLE TRIGGER signature_immutable;
+
+-- A translation of an agreement text into another language.
+CREATE TABLE agreement_text_translation (
+    id                bigserial   PRIMARY KEY,
+    agreement_text_id bigint      NOT NULL REFERENCES agreement_text (id),
+    language          text        NOT NULL,
+    title             text,
+    content           text        NOT NULL,
+    created           timestamptz NOT NULL DEFAULT now(),
+    version           bigint      NOT NULL DEFAULT 1,
+    UNIQUE (agreement_text_id, language)
+);
+
+-- Once a translation has been signed, it can't be changed or removed.
+CREATE FUNCTION reject_signed_translation_change() RETURNS trigger AS $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM signature
+               WHERE signed_agreement_text_id = OLD.agreement_text_id AND language = OLD.language) THEN
+        RAISE EXCEPTION 'the % translation of agreement text % has been signed and is immutable',
+            OLD.language, OLD.agreement_text_id
+            USING ERRCODE = 'restrict_violation';
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER agreement_text_translation_immutable_when_signed
+    BEFORE UPDATE OR DELETE ON agreement_text_translation
+    FOR EACH ROW EXECUTE PROCEDURE reject_signed_translation_change();
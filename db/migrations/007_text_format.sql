@@ -0,0 +1,9 @@
+-- Records the format of each agreement text's content. Existing texts
+-- were written as plain text and keep being shown as they were signed.
+-- New texts are Markdown by default.
+
+SET search_path TO webapp;
+
+ALTER TABLE agreement_text ADD COLUMN format text NOT NULL DEFAULT 'plain'
+    CHECK (format IN ('plain', 'markdown'));
+ALTER TABLE agreement_text ALTER COLUMN format SET DEFAULT 'markdown';
@@ -0,0 +1,5 @@
+-- Records which owners are emailed when someone signs their agreement.
+
+SET search_path TO webapp;
+
+ALTER TABLE owner ADD COLUMN notify_signatures boolean NOT NULL DEFAULT false;
@@ -0,0 +1,45 @@
+-- Adds reminder campaigns, the reminders they send, and opting out of them.
+
+SET search_path TO webapp;
+
+-- A reminder campaign emails the people in a target population who
+-- haven't signed the current text of an agreement.
+CREATE TABLE reminder_campaign (
+    id            bigserial   PRIMARY KEY,
+    agreement_id  bigint      NOT NULL REFERENCES agreement (id),
+    target_kind   text        NOT NULL CHECK (target_kind IN ('group', 'filter', 'usertypes')),
+    target        text        NOT NULL,
+    message       text        NOT NULL DEFAULT '',
+    start_date    timestamptz NOT NULL,
+    interval_days integer     NOT NULL CHECK (interval_days > 0),
+    max_reminders integer     NOT NULL CHECK (max_reminders > 0),
+    hourly_limit  integer     NOT NULL CHECK (hourly_limit > 0),
+    enabled       boolean     NOT NULL DEFAULT true,
+    created       timestamptz NOT NULL,
+    created_by    text        NOT NULL,
+    last_run      timestamptz,
+    version       bigint      NOT NULL DEFAULT 1
+);
+
+-- Each reminder sent, the history of the campaigns. Reminders are append-only.
+CREATE TABLE reminder (
+    id                bigserial   PRIMARY KEY,
+    campaign_id       bigint      NOT NULL REFERENCES reminder_campaign (id),
+    agreement_text_id bigint      NOT NULL REFERENCES agreement_text (id),
+    username          text        NOT NULL,
+    email             text        NOT NULL,
+    sent              timestamptz NOT NULL
+);
+
+CREATE INDEX reminder_campaign_sent ON reminder (campaign_id, sent);
+
+CREATE TRIGGER reminder_immutable BEFORE UPDATE OR DELETE ON reminder
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+-- The people who asked not to be reminded about an agreement.
+CREATE TABLE reminder_opt_out (
+    agreement_id bigint      NOT NULL REFERENCES agreement (id),
+    username     text        NOT NULL,
+    created      timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (agreement_id, username)
+);
@@ -0,0 +1,19 @@
+-- Keeps the public key of every receipt signing key, so receipts signed
+-- before a key was rotated can still be verified.
+
+SET search_path TO webapp;
+
+-- The public keys receipts have been signed with. The ID is the start
+-- of the hex encoded SHA-256 of the key.
+CREATE TABLE receipt_key (
+    id         text        PRIMARY KEY,
+    public_key bytea       NOT NULL UNIQUE,
+    created    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER receipt_key_immutable BEFORE UPDATE OR DELETE ON receipt_key
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+-- Receipts stored before this migration don't name their key, and are
+-- verified against each known key.
+ALTER TABLE receipt ADD COLUMN key_id text REFERENCES receipt_key (id);
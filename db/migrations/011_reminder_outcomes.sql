@@ -0,0 +1,15 @@
+-- Records whether each reminder was sent. Reminders are recorded when
+-- they're queued, and the mail queue may fail to send them.
+
+SET search_path TO webapp;
+
+-- The outcome of sending a reminder. Reminders without an outcome are
+-- still queued, or were lost when the server stopped.
+CREATE TABLE reminder_outcome (
+    reminder_id bigint      PRIMARY KEY REFERENCES reminder (id),
+    outcome     text        NOT NULL CHECK (outcome IN ('sent', 'failed')),
+    recorded    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER reminder_outcome_immutable BEFORE UPDATE OR DELETE ON reminder_outcome
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
@@ -15,6 +15,7 @@ type Agreement struct {
 	Description string
 	Created     time.Time
 	Enabled     bool
+	Version     int64
 }
 
 func NewAgreement(title, description string) *Agreement {
@@ -27,9 +28,10 @@ func NewAgreement(title, description string) *Agreement {
 }
 
 type Owner struct {
-	ID              int64
-	OwnsAgreementID int64
-	Username        string
+	ID               int64
+	OwnsAgreementID  int64
+	Username         string
+	NotifySignatures bool
 }
 
 type AgreementText struct {
@@ -40,6 +42,29 @@ type AgreementText struct {
 	Created                 time.Time
 	EnactmentDate           time.Time
 	ReplacesAgreementTextID int64
+	Version                 int64
+	Language                string
+	Format                  TextFormat
+}
+
+// The format of an agreement text's content.
+// Its translations are in the same format.
+type TextFormat string
+
+const (
+	Markdown  TextFormat = "markdown"
+	PlainText TextFormat = "plain"
+)
+
+// An AgreementTextTranslation is an agreement text in another language.
+type AgreementTextTranslation struct {
+	ID              int64
+	AgreementTextID int64
+	Language        string
+	Title           sql.NullString
+	Content         string
+	Created         time.Time
+	Version         int64
 }
 
 type UserType string
@@ -62,4 +87,89 @@ type Signature struct {
 	Department            string
 	BannerID              int64
 	SignedTimestampUTC    time.Time
+	ContentSHA256         string
+	Language              string
+}
+
+// A ReminderCampaign emails the people in a target population who
+// haven't signed the current text of an agreement, every IntervalDays
+// from StartDate, up to MaxReminders times each. No more than
+// HourlyLimit reminders are sent in an hour.
+type ReminderCampaign struct {
+	ID           int64
+	AgreementID  int64
+	TargetKind   TargetKind
+	Target       string
+	Message      string
+	StartDate    time.Time
+	IntervalDays int
+	MaxReminders int
+	HourlyLimit  int
+	Enabled      bool
+	Created      time.Time
+	CreatedBy    string
+	Version      int64
+
+	// The number of reminders the campaign has sent.
+	RemindersSent int64
+}
+
+// Who a reminder campaign targets. The target of a group campaign is
+// the group's DN, of a filter campaign an LDAP search filter, and of a
+// user type campaign the user types, separated by commas.
+type TargetKind string
+
+const (
+	TargetGroup     TargetKind = "group"
+	TargetFilter    TargetKind = "filter"
+	TargetUserTypes TargetKind = "usertypes"
+)
+
+// A Reminder is an email sent by a reminder campaign. Sent is when it
+// was queued to be sent, and Outcome is whether the mail queue sent it.
+type Reminder struct {
+	ID              int64
+	CampaignID      int64
+	AgreementTextID int64
+	Username        string
+	Email           string
+	Sent            time.Time
+	Outcome         ReminderOutcome
+}
+
+type ReminderOutcome string
+
+const (
+	ReminderQueued ReminderOutcome = "queued"
+	ReminderSent   ReminderOutcome = "sent"
+	ReminderFailed ReminderOutcome = "failed"
+)
+
+// A Correction amends a signature or a signed agreement text without
+// changing it. Exactly one of SignatureID and AgreementTextID is set.
+type Correction struct {
+	ID              int64
+	SignatureID     int64
+	AgreementTextID int64
+	Field           string
+	OldValue        string
+	NewValue        string
+	CorrectedBy     string
+	Reason          string
+	Created         time.Time
+}
+
+// A Receipt is the PDF receipt of a signature, signed by the server.
+type Receipt struct {
+	SignatureID      int64
+	PDF              []byte
+	Ed25519Signature []byte
+	KeyID            string
+	Created          time.Time
+}
+
+type ReceiptKey struct {
+	ID        string
+	PublicKey []byte
+	Created   time.Time
 }
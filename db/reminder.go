@@ -0,0 +1,286 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Store saves the campaign. A zero ID inserts a new campaign, otherwise
+// the existing campaign is updated if its version in the database still
+// matches campaign.Version.
+func (campaign *ReminderCampaign) Store() (int64, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var returnedID, returnedVersion int64
+
+	if campaign.ID == 0 {
+		err = tx.QueryRow("INSERT INTO reminder_campaign(agreement_id,target_kind,target,message,"+
+			"start_date,interval_days,max_reminders,hourly_limit,enabled,created,created_by) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) "+
+			"RETURNING id, version;",
+			campaign.AgreementID,
+			campaign.TargetKind,
+			campaign.Target,
+			campaign.Message,
+			campaign.StartDate,
+			campaign.IntervalDays,
+			campaign.MaxReminders,
+			campaign.HourlyLimit,
+			campaign.Enabled,
+			campaign.Created,
+			campaign.CreatedBy).Scan(&returnedID, &returnedVersion)
+	} else {
+		err = tx.QueryRow("UPDATE reminder_campaign "+
+			"SET target_kind = $1, target = $2, message = $3, start_date = $4, interval_days = $5, "+
+			"max_reminders = $6, hourly_limit = $7, enabled = $8, version = version + 1 "+
+			"WHERE id = $9 AND version = $10 "+
+			"RETURNING id, version;",
+			campaign.TargetKind,
+			campaign.Target,
+			campaign.Message,
+			campaign.StartDate,
+			campaign.IntervalDays,
+			campaign.MaxReminders,
+			campaign.HourlyLimit,
+			campaign.Enabled,
+			campaign.ID,
+			campaign.Version).Scan(&returnedID, &returnedVersion)
+		if err == sql.ErrNoRows {
+			err = ErrConflict
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	campaign.ID = returnedID
+	campaign.Version = returnedVersion
+	return returnedID, nil
+}
+
+const selectReminderCampaign = "SELECT c.id, c.agreement_id, c.target_kind, c.target, c.message, " +
+	"c.start_date, c.interval_days, c.max_reminders, c.hourly_limit, c.enabled, c.created, " +
+	"c.created_by, c.version, (SELECT count(*) FROM reminder r WHERE r.campaign_id = c.id) " +
+	"FROM reminder_campaign c "
+
+func scanReminderCampaign(row interface {
+	Scan(dest ...interface{}) error
+}) (*ReminderCampaign, error) {
+	campaign := new(ReminderCampaign)
+	err := row.Scan(&campaign.ID,
+		&campaign.AgreementID,
+		&campaign.TargetKind,
+		&campaign.Target,
+		&campaign.Message,
+		&campaign.StartDate,
+		&campaign.IntervalDays,
+		&campaign.MaxReminders,
+		&campaign.HourlyLimit,
+		&campaign.Enabled,
+		&campaign.Created,
+		&campaign.CreatedBy,
+		&campaign.Version,
+		&campaign.RemindersSent)
+	if err != nil {
+		return nil, err
+	}
+	return campaign, nil
+}
+
+func queryReminderCampaigns(query string, args ...interface{}) ([]*ReminderCampaign, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := []*ReminderCampaign{}
+	for rows.Next() {
+		campaign, err := scanReminderCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, campaign)
+	}
+	return campaigns, rows.Err()
+}
+
+// GetReminderCampaign loads a reminder campaign by its ID.
+func GetReminderCampaign(id int64) (*ReminderCampaign, error) {
+	return scanReminderCampaign(db.QueryRow(selectReminderCampaign+"WHERE c.id = $1;", id))
+}
+
+// ReminderCampaigns returns the agreement's reminder campaigns, newest first.
+func ReminderCampaigns(agreementID int64) ([]*ReminderCampaign, error) {
+	return queryReminderCampaigns(selectReminderCampaign+
+		"WHERE c.agreement_id = $1 "+
+		"ORDER BY c.created DESC;", agreementID)
+}
+
+// DueReminderCampaigns returns the enabled campaigns of enabled
+// agreements which have started by now.
+func DueReminderCampaigns(now time.Time) ([]*ReminderCampaign, error) {
+	return queryReminderCampaigns(selectReminderCampaign+
+		"JOIN agreement a ON a.id = c.agreement_id "+
+		"WHERE c.enabled AND a.enabled AND c.start_date <= $1 "+
+		"ORDER BY c.id;", now)
+}
+
+// ClaimReminderCampaign reports whether the campaign can be run now,
+// recording that it's being run. A campaign can't be claimed again
+// until the interval has passed, so only one server sends its reminders.
+func ClaimReminderCampaign(id int64, interval time.Duration) (bool, error) {
+	result, err := db.Exec("UPDATE reminder_campaign SET last_run = now() "+
+		"WHERE id = $1 AND (last_run IS NULL OR last_run <= now() - make_interval(secs => $2));",
+		id, interval.Seconds())
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed == 1, err
+}
+
+// Store records the reminder. Reminders can't be changed afterwards.
+func (reminder *Reminder) Store() (int64, error) {
+	err := db.QueryRow("INSERT INTO reminder(campaign_id,agreement_text_id,username,email,sent) "+
+		"VALUES($1,$2,$3,$4,$5) "+
+		"RETURNING id;",
+		reminder.CampaignID,
+		reminder.AgreementTextID,
+		reminder.Username,
+		reminder.Email,
+		reminder.Sent).Scan(&reminder.ID)
+	return reminder.ID, err
+}
+
+// RecordReminderOutcome records whether the reminder was sent. Only
+// the first outcome recorded is kept.
+func RecordReminderOutcome(reminderID int64, outcome ReminderOutcome) error {
+	_, err := db.Exec("INSERT INTO reminder_outcome(reminder_id,outcome) "+
+		"VALUES($1,$2) "+
+		"ON CONFLICT DO NOTHING;", reminderID, outcome)
+	return err
+}
+
+// Reminders returns up to limit of the campaign's reminders, newest first.
+func Reminders(campaignID int64, limit int) ([]*Reminder, error) {
+	rows, err := db.Query("SELECT r.id, r.campaign_id, r.agreement_text_id, r.username, r.email, r.sent, "+
+		"COALESCE(o.outcome, $3) "+
+		"FROM reminder r LEFT JOIN reminder_outcome o ON o.reminder_id = r.id "+
+		"WHERE r.campaign_id = $1 "+
+		"ORDER BY r.sent DESC, r.id DESC LIMIT $2;", campaignID, limit, ReminderQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reminders := []*Reminder{}
+	for rows.Next() {
+		reminder := new(Reminder)
+		err := rows.Scan(&reminder.ID,
+			&reminder.CampaignID,
+			&reminder.AgreementTextID,
+			&reminder.Username,
+			&reminder.Email,
+			&reminder.Sent,
+			&reminder.Outcome)
+		if err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, reminder)
+	}
+	return reminders, rows.Err()
+}
+
+// RemindersSentSince returns how many reminders the campaign queued
+// since the time, leaving out the ones which failed to send.
+func RemindersSentSince(campaignID int64, since time.Time) (int, error) {
+	var sent int
+	err := db.QueryRow("SELECT count(*) FROM reminder r "+
+		"LEFT JOIN reminder_outcome o ON o.reminder_id = r.id "+
+		"WHERE r.campaign_id = $1 AND r.sent > $2 AND o.outcome IS DISTINCT FROM $3;",
+		campaignID, since, ReminderFailed).Scan(&sent)
+	return sent, err
+}
+
+// A ReminderTally is how many reminders someone was sent by a
+// campaign about an agreement text, and when the last one was sent.
+type ReminderTally struct {
+	Count int
+	Last  time.Time
+}
+
+// ReminderTallies returns the tally of each person the campaign has
+// reminded about the agreement text, by username. Reminders which
+// failed to send aren't counted, and neither are reminders queued
+// before lostBefore without an outcome, which were lost when a server
+// stopped. Reminders still queued are counted, so they aren't sent twice.
+func ReminderTallies(campaignID, agreementTextID int64, lostBefore time.Time) (map[string]ReminderTally, error) {
+	rows, err := db.Query("SELECT r.username, count(*), max(r.sent) FROM reminder r "+
+		"LEFT JOIN reminder_outcome o ON o.reminder_id = r.id "+
+		"WHERE r.campaign_id = $1 AND r.agreement_text_id = $2 "+
+		"AND (o.outcome = $3 OR (o.outcome IS NULL AND r.sent > $4)) "+
+		"GROUP BY r.username;", campaignID, agreementTextID, ReminderSent, lostBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tallies := map[string]ReminderTally{}
+	for rows.Next() {
+		var username string
+		var tally ReminderTally
+		err := rows.Scan(&username, &tally.Count, &tally.Last)
+		if err != nil {
+			return nil, err
+		}
+		tallies[username] = tally
+	}
+	return tallies, rows.Err()
+}
+
+// OptOutOfReminders records that the user doesn't want reminders about
+// the agreement. Opting out again changes nothing.
+func OptOutOfReminders(agreementID int64, username string) error {
+	_, err := db.Exec("INSERT INTO reminder_opt_out(agreement_id,username) "+
+		"VALUES($1,$2) "+
+		"ON CONFLICT DO NOTHING;", agreementID, username)
+	return err
+}
+
+// OptedOutOfReminders returns the usernames of the people who don't
+// want reminders about the agreement.
+func OptedOutOfReminders(agreementID int64) (map[string]bool, error) {
+	rows, err := db.Query("SELECT username FROM reminder_opt_out "+
+		"WHERE agreement_id = $1;", agreementID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usernames := map[string]bool{}
+	for rows.Next() {
+		var username string
+		err := rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		usernames[username] = true
+	}
+	return usernames, rows.Err()
+}
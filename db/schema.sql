@@ -0,0 +1,234 @@
+-- Copyright 2015 Carleton University Library All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license that can be found in the LICENSE file.
+
+-- Database creation script for signtwo.
+-- All tables live in the webapp schema. The role signtwo connects as
+-- should have webapp on its search_path, for example:
+--   ALTER ROLE signtwo SET search_path TO webapp;
+-- Existing databases should apply the files in db/migrations in order instead.
+
+CREATE SCHEMA IF NOT EXISTS webapp;
+SET search_path TO webapp;
+
+CREATE TABLE agreement (
+    id          bigserial   PRIMARY KEY,
+    title       text        NOT NULL,
+    description text        NOT NULL,
+    created     timestamptz NOT NULL,
+    enabled     boolean     NOT NULL DEFAULT true,
+    version     bigint      NOT NULL DEFAULT 1
+);
+
+CREATE TABLE owner (
+    id                bigserial PRIMARY KEY,
+    owns_agreement_id bigint    NOT NULL REFERENCES agreement (id),
+    username          text      NOT NULL,
+    notify_signatures boolean   NOT NULL DEFAULT false,
+    UNIQUE (owns_agreement_id, username)
+);
+
+CREATE TABLE agreement_text (
+    id                         bigserial   PRIMARY KEY,
+    base_agreement_id          bigint      NOT NULL REFERENCES agreement (id),
+    title                      text,
+    content                    text        NOT NULL,
+    created                    timestamptz NOT NULL,
+    enactment_date             timestamptz NOT NULL,
+    replaces_agreement_text_id bigint      REFERENCES agreement_text (id),
+    version                    bigint      NOT NULL DEFAULT 1,
+    language                   text        NOT NULL DEFAULT 'en',
+    format                     text        NOT NULL DEFAULT 'markdown'
+                                           CHECK (format IN ('plain', 'markdown'))
+);
+
+CREATE TABLE signature (
+    id                       bigserial   PRIMARY KEY,
+    signed_agreement_text_id bigint      NOT NULL REFERENCES agreement_text (id),
+    username                 text        NOT NULL,
+    first_name               text        NOT NULL,
+    last_name                text        NOT NULL,
+    user_type                text        NOT NULL,
+    email                    text        NOT NULL,
+    department               text        NOT NULL,
+    banner_id                bigint      NOT NULL,
+    signed_timestamp_utc     timestamp   NOT NULL,
+    content_sha256           char(64),   -- NULL for signatures made before hashes were recorded
+    language                 text        NOT NULL DEFAULT 'en'
+);
+
+-- Corrections are the only way to amend a signature or a signed text.
+-- Each one records what changed, who made the change, and why.
+CREATE TABLE correction (
+    id                bigserial   PRIMARY KEY,
+    signature_id      bigint      REFERENCES signature (id),
+    agreement_text_id bigint      REFERENCES agreement_text (id),
+    field             text        NOT NULL,
+    old_value         text        NOT NULL,
+    new_value         text        NOT NULL,
+    corrected_by      text        NOT NULL,
+    reason            text        NOT NULL,
+    created           timestamptz NOT NULL DEFAULT now(),
+    CHECK ((signature_id IS NULL) <> (agreement_text_id IS NULL))
+);
+
+-- Signatures and corrections are append-only.
+-- The restrict_violation error code is mapped to db.ErrImmutable.
+CREATE FUNCTION reject_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION '% rows are immutable, record a correction instead', TG_TABLE_NAME
+        USING ERRCODE = 'restrict_violation';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER signature_immutable BEFORE UPDATE OR DELETE ON signature
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+CREATE TRIGGER correction_immutable BEFORE UPDATE OR DELETE ON correction
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+-- Once an agreement text has been signed, it can't be changed or removed.
+CREATE FUNCTION reject_signed_text_change() RETURNS trigger AS $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM signature WHERE signed_agreement_text_id = OLD.id) THEN
+        RAISE EXCEPTION 'agreement text % has been signed and is immutable', OLD.id
+            USING ERRCODE = 'restrict_violation';
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER agreement_text_immutable_when_signed BEFORE UPDATE OR DELETE ON agreement_text
+    FOR EACH ROW EXECUTE PROCEDURE reject_signed_text_change();
+
+-- A translation of an agreement text into another language.
+CREATE TABLE agreement_text_translation (
+    id                bigserial   PRIMARY KEY,
+    agreement_text_id bigint      NOT NULL REFERENCES agreement_text (id),
+    language          text        NOT NULL,
+    title             text,
+    content           text        NOT NULL,
+    created           timestamptz NOT NULL DEFAULT now(),
+    version           bigint      NOT NULL DEFAULT 1,
+    UNIQUE (agreement_text_id, language)
+);
+
+-- Once a translation has been signed, it can't be changed or removed.
+CREATE FUNCTION reject_signed_translation_change() RETURNS trigger AS $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM signature
+               WHERE signed_agreement_text_id = OLD.agreement_text_id AND language = OLD.language) THEN
+        RAISE EXCEPTION 'the % translation of agreement text % has been signed and is immutable',
+            OLD.language, OLD.agreement_text_id
+            USING ERRCODE = 'restrict_violation';
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER agreement_text_translation_immutable_when_signed
+    BEFORE UPDATE OR DELETE ON agreement_text_translation
+    FOR EACH ROW EXECUTE PROCEDURE reject_signed_translation_change();
+
+-- The tamper-evident audit log. Each entry's hash covers the hash of
+-- the entry before it, see the audit package.
+CREATE TABLE audit_log (
+    id        bigserial   PRIMARY KEY,
+    timestamp timestamptz NOT NULL,
+    event     text        NOT NULL,
+    actor     text        NOT NULL,
+    subject   text        NOT NULL,
+    details   text        NOT NULL,
+    prev_hash char(64)    NOT NULL UNIQUE,
+    hash      char(64)    NOT NULL UNIQUE
+);
+
+CREATE TRIGGER audit_log_immutable BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE PROCEDURE reject_change();
+
+-- The public keys receipts have been signed with, kept after the key
+-- is rotated. The ID is the start of the hex encoded SHA-256 of the key.
+CREATE TABLE receipt_key (
+    id         text        PRIMARY KEY,
+    public_key bytea       NOT NULL UNIQUE,
+    created    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER receipt_key_immutable BEFORE UPDATE OR DELETE ON receipt_key
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+-- The PDF receipt of each signature, and its detached Ed25519 signature.
+-- The key ID is null for receipts stored before keys were recorded.
+CREATE TABLE receipt (
+    signature_id      bigint      PRIMARY KEY REFERENCES signature (id),
+    pdf               bytea       NOT NULL,
+    ed25519_signature bytea       NOT NULL,
+    created           timestamptz NOT NULL DEFAULT now(),
+    key_id            text        REFERENCES receipt_key (id)
+);
+
+CREATE TRIGGER receipt_immutable BEFORE UPDATE OR DELETE ON receipt
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+-- A reminder campaign emails the people in a target population who
+-- haven't signed the current text of an agreement.
+CREATE TABLE reminder_campaign (
+    id            bigserial   PRIMARY KEY,
+    agreement_id  bigint      NOT NULL REFERENCES agreement (id),
+    target_kind   text        NOT NULL CHECK (target_kind IN ('group', 'filter', 'usertypes')),
+    target        text        NOT NULL,
+    message       text        NOT NULL DEFAULT '',
+    start_date    timestamptz NOT NULL,
+    interval_days integer     NOT NULL CHECK (interval_days > 0),
+    max_reminders integer     NOT NULL CHECK (max_reminders > 0),
+    hourly_limit  integer     NOT NULL CHECK (hourly_limit > 0),
+    enabled       boolean     NOT NULL DEFAULT true,
+    created       timestamptz NOT NULL,
+    created_by    text        NOT NULL,
+    last_run      timestamptz,
+    version       bigint      NOT NULL DEFAULT 1
+);
+
+-- Each reminder sent, the history of the campaigns. Reminders are append-only.
+CREATE TABLE reminder (
+    id                bigserial   PRIMARY KEY,
+    campaign_id       bigint      NOT NULL REFERENCES reminder_campaign (id),
+    agreement_text_id bigint      NOT NULL REFERENCES agreement_text (id),
+    username          text        NOT NULL,
+    email             text        NOT NULL,
+    sent              timestamptz NOT NULL
+);
+
+CREATE INDEX reminder_campaign_sent ON reminder (campaign_id, sent);
+
+CREATE TRIGGER reminder_immutable BEFORE UPDATE OR DELETE ON reminder
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+-- The outcome of sending a reminder, which is recorded when it's queued.
+-- Reminders without an outcome are still queued, or were lost when the
+-- server stopped.
+CREATE TABLE reminder_outcome (
+    reminder_id bigint      PRIMARY KEY REFERENCES reminder (id),
+    outcome     text        NOT NULL CHECK (outcome IN ('sent', 'failed')),
+    recorded    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TRIGGER reminder_outcome_immutable BEFORE UPDATE OR DELETE ON reminder_outcome
+    FOR EACH ROW EXECUTE PROCEDURE reject_change();
+
+-- The people who asked not to be reminded about an agreement.
+CREATE TABLE reminder_opt_out (
+    agreement_id bigint      NOT NULL REFERENCES agreement (id),
+    username     text        NOT NULL,
+    created      timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (agreement_id, username)
+);
@@ -0,0 +1,455 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+// ContentHash returns the hex encoded SHA-256 of agreement text content.
+//
+// The hash is of the stored content, which for a Markdown text is its
+// source, not the sanitized HTML the signer saw. The HTML is rendered
+// from the source, so the source determines what was shown, and its
+// hash stays the same when the Markdown renderer or sanitizer is
+// upgraded, which would change the HTML of every old signature.
+func ContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store inserts the signature. Signatures can't be changed once
+// stored, so Store returns ErrImmutable if the signature has an ID.
+// It returns ErrContentChanged if the content in the signature's
+// language no longer has the signature's content hash.
+func (signature *Signature) Store() (int64, error) {
+	if signature.ID != 0 {
+		return 0, ErrImmutable
+	}
+	if len(signature.ContentSHA256) != sha256.Size*2 {
+		return 0, errors.New("A signature must record the hash of the content which was signed.")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The signed content is locked until the signature is stored, so it
+	// can't be edited between checking its hash and the insert. Once the
+	// signature is stored, the triggers keep it from being edited at all.
+	var textLanguage, content string
+	err = tx.QueryRow("SELECT language, content FROM agreement_text "+
+		"WHERE id = $1 FOR SHARE;", signature.SignedAgreementTextID).Scan(&textLanguage, &content)
+	if err != nil {
+		return 0, err
+	}
+	if signature.Language != "" && signature.Language != textLanguage {
+		err = tx.QueryRow("SELECT content FROM agreement_text_translation "+
+			"WHERE agreement_text_id = $1 AND language = $2 FOR SHARE;",
+			signature.SignedAgreementTextID, signature.Language).Scan(&content)
+		if err == sql.ErrNoRows {
+			return 0, ErrContentChanged
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if ContentHash(content) != signature.ContentSHA256 {
+		return 0, ErrContentChanged
+	}
+
+	err = tx.QueryRow("INSERT INTO signature(signed_agreement_text_id,username,first_name,"+
+		"last_name,user_type,email,department,banner_id,signed_timestamp_utc,content_sha256,language) "+
+		"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,COALESCE(NULLIF($11,''),'en')) "+
+		"RETURNING id;",
+		signature.SignedAgreementTextID,
+		signature.Username,
+		signature.FirstName,
+		signature.LastName,
+		string(signature.UserType),
+		signature.Email,
+		signature.Department,
+		signature.BannerID,
+		signature.SignedTimestampUTC,
+		signature.ContentSHA256,
+		signature.Language).Scan(&signature.ID)
+	if err != nil {
+		signature.ID = 0
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		signature.ID = 0
+		return 0, err
+	}
+	return signature.ID, nil
+}
+
+// IsSigned reports whether anyone has signed the agreement text.
+func IsSigned(agreementTextID int64) (bool, error) {
+	var signed bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM signature "+
+		"WHERE signed_agreement_text_id = $1);", agreementTextID).Scan(&signed)
+	return signed, err
+}
+
+const selectSignature = "SELECT id, signed_agreement_text_id, username, first_name, last_name, " +
+	"user_type, email, department, banner_id, signed_timestamp_utc, content_sha256, language " +
+	"FROM signature "
+
+func scanSignature(row interface {
+	Scan(dest ...interface{}) error
+}, extra ...interface{}) (*Signature, error) {
+	signature := new(Signature)
+	var userType string
+	var contentSHA256 sql.NullString
+	dest := []interface{}{&signature.ID,
+		&signature.SignedAgreementTextID,
+		&signature.Username,
+		&signature.FirstName,
+		&signature.LastName,
+		&userType,
+		&signature.Email,
+		&signature.Department,
+		&signature.BannerID,
+		&signature.SignedTimestampUTC,
+		&contentSHA256,
+		&signature.Language}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	signature.UserType = UserType(userType)
+	signature.ContentSHA256 = contentSHA256.String
+	return signature, nil
+}
+
+// GetSignature loads the signature with the given ID.
+func GetSignature(id int64) (*Signature, error) {
+	return scanSignature(db.QueryRow(selectSignature+"WHERE id = $1;", id))
+}
+
+// SignedLanguages returns the languages the agreement text has been signed in.
+func SignedLanguages(agreementTextID int64) (map[string]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT language FROM signature "+
+		"WHERE signed_agreement_text_id = $1;", agreementTextID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	languages := map[string]bool{}
+	for rows.Next() {
+		var language string
+		err := rows.Scan(&language)
+		if err != nil {
+			return nil, err
+		}
+		languages[language] = true
+	}
+	return languages, rows.Err()
+}
+
+// SignedUsernames returns the usernames of everyone who signed the agreement text.
+func SignedUsernames(agreementTextID int64) (map[string]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT username FROM signature "+
+		"WHERE signed_agreement_text_id = $1;", agreementTextID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usernames := map[string]bool{}
+	for rows.Next() {
+		var username string
+		err := rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		usernames[username] = true
+	}
+	return usernames, rows.Err()
+}
+
+// LastSignatureLanguages returns the language each of the users last
+// signed in, by username. Users who haven't signed anything are left out.
+func LastSignatureLanguages(usernames []string) (map[string]string, error) {
+	rows, err := db.Query("SELECT DISTINCT ON (username) username, language FROM signature "+
+		"WHERE username = ANY($1) "+
+		"ORDER BY username, signed_timestamp_utc DESC;", pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	languages := map[string]string{}
+	for rows.Next() {
+		var username, language string
+		err := rows.Scan(&username, &language)
+		if err != nil {
+			return nil, err
+		}
+		languages[username] = language
+	}
+	return languages, rows.Err()
+}
+
+// HasSigned reports whether the user has signed the agreement text.
+func HasSigned(username string, agreementTextID int64) (bool, error) {
+	var signed bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM signature "+
+		"WHERE username = $1 AND signed_agreement_text_id = $2);",
+		username, agreementTextID).Scan(&signed)
+	return signed, err
+}
+
+// GetUserSignature loads the user's signature of the agreement text.
+// It returns sql.ErrNoRows if the user hasn't signed it.
+func GetUserSignature(username string, agreementTextID int64) (*Signature, error) {
+	return scanSignature(db.QueryRow(selectSignature+
+		"WHERE username = $1 AND signed_agreement_text_id = $2 "+
+		"ORDER BY id LIMIT 1;", username, agreementTextID))
+}
+
+// LatestUserSignature loads the user's most recent signature of any
+// text of the agreement. It returns sql.ErrNoRows if the user hasn't
+// signed the agreement.
+func LatestUserSignature(username string, agreementID int64) (*Signature, error) {
+	return scanSignature(db.QueryRow("SELECT s.id, s.signed_agreement_text_id, s.username, "+
+		"s.first_name, s.last_name, s.user_type, s.email, s.department, s.banner_id, "+
+		"s.signed_timestamp_utc, s.content_sha256, s.language "+
+		"FROM signature s JOIN agreement_text t ON t.id = s.signed_agreement_text_id "+
+		"WHERE s.username = $1 AND t.base_agreement_id = $2 "+
+		"ORDER BY s.signed_timestamp_utc DESC, s.id DESC LIMIT 1;", username, agreementID))
+}
+
+// Store inserts the receipt. Receipts can't be replaced once stored, so
+// if the signature already has a receipt, perhaps stored by a concurrent
+// request, Store loads the stored receipt into receipt instead.
+func (receipt *Receipt) Store() error {
+	err := db.QueryRow("INSERT INTO receipt(signature_id,pdf,ed25519_signature,key_id) "+
+		"VALUES($1,$2,$3,$4) "+
+		"ON CONFLICT (signature_id) DO NOTHING "+
+		"RETURNING created;",
+		receipt.SignatureID,
+		receipt.PDF,
+		receipt.Ed25519Signature,
+		receipt.KeyID).Scan(&receipt.Created)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	stored, err := GetReceipt(receipt.SignatureID)
+	if err != nil {
+		return err
+	}
+	*receipt = *stored
+	return nil
+}
+
+// GetReceipt loads the receipt of a signature.
+// It returns sql.ErrNoRows if no receipt has been stored.
+func GetReceipt(signatureID int64) (*Receipt, error) {
+	receipt := new(Receipt)
+	err := db.QueryRow("SELECT signature_id, pdf, ed25519_signature, COALESCE(key_id, ''), created "+
+		"FROM receipt "+
+		"WHERE signature_id = $1;", signatureID).Scan(
+		&receipt.SignatureID,
+		&receipt.PDF,
+		&receipt.Ed25519Signature,
+		&receipt.KeyID,
+		&receipt.Created)
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// RegisterReceiptKey records a receipt signing key's public key.
+// Registering a key which is already recorded does nothing.
+func RegisterReceiptKey(id string, publicKey []byte) error {
+	_, err := db.Exec("INSERT INTO receipt_key(id,public_key) "+
+		"VALUES($1,$2) "+
+		"ON CONFLICT (id) DO NOTHING;", id, publicKey)
+	return err
+}
+
+// ReceiptKeys loads every recorded receipt signing key, newest first.
+func ReceiptKeys() ([]*ReceiptKey, error) {
+	rows, err := db.Query("SELECT id, public_key, created " +
+		"FROM receipt_key " +
+		"ORDER BY created DESC, id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*ReceiptKey{}
+	for rows.Next() {
+		key := new(ReceiptKey)
+		err := rows.Scan(&key.ID, &key.PublicKey, &key.Created)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// A HashCheck compares the content hash recorded with a signature
+// against the hash of its agreement text's content as it is now.
+type HashCheck struct {
+	Signature     *Signature
+	CurrentSHA256 string
+}
+
+// Verifiable reports whether a hash was recorded with the signature.
+// Signatures made before hashes were recorded can't be checked.
+func (check *HashCheck) Verifiable() bool {
+	return check.Signature.ContentSHA256 != ""
+}
+
+// Matches reports whether the signed content is unchanged.
+func (check *HashCheck) Matches() bool {
+	return check.Verifiable() && check.Signature.ContentSHA256 == check.CurrentSHA256
+}
+
+// The content each signer read: their text's own content, or its
+// translation into the language they signed in.
+const signedContent = "CASE WHEN s.language = t.language THEN t.content " +
+	"ELSE COALESCE(tr.content, t.content) END "
+
+// VerifySignature recomputes the content hash of a signature's agreement text.
+func VerifySignature(signatureID int64) (*HashCheck, error) {
+	var content string
+	signature, err := scanSignature(db.QueryRow("SELECT s.id, s.signed_agreement_text_id, s.username, "+
+		"s.first_name, s.last_name, s.user_type, s.email, s.department, s.banner_id, "+
+		"s.signed_timestamp_utc, s.content_sha256, s.language, "+signedContent+
+		"FROM signature s JOIN agreement_text t ON t.id = s.signed_agreement_text_id "+
+		"LEFT JOIN agreement_text_translation tr "+
+		"ON tr.agreement_text_id = t.id AND tr.language = s.language "+
+		"WHERE s.id = $1;", signatureID), &content)
+	if err != nil {
+		return nil, err
+	}
+	return &HashCheck{Signature: signature, CurrentSHA256: ContentHash(content)}, nil
+}
+
+// VerifyAgreementSignatures recomputes the content hash of every
+// signature of every text of the agreement, newest first.
+func VerifyAgreementSignatures(agreementID int64) ([]*HashCheck, error) {
+	rows, err := db.Query("SELECT s.id, s.signed_agreement_text_id, s.username, "+
+		"s.first_name, s.last_name, s.user_type, s.email, s.department, s.banner_id, "+
+		"s.signed_timestamp_utc, s.content_sha256, s.language, "+signedContent+
+		"FROM signature s JOIN agreement_text t ON t.id = s.signed_agreement_text_id "+
+		"LEFT JOIN agreement_text_translation tr "+
+		"ON tr.agreement_text_id = t.id AND tr.language = s.language "+
+		"WHERE t.base_agreement_id = $1 "+
+		"ORDER BY s.signed_timestamp_utc DESC, s.id DESC;", agreementID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := []*HashCheck{}
+	for rows.Next() {
+		var content string
+		signature, err := scanSignature(rows, &content)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, &HashCheck{Signature: signature, CurrentSHA256: ContentHash(content)})
+	}
+	return checks, rows.Err()
+}
+
+// NewSignatureCorrection creates a correction of one field of a signature.
+func NewSignatureCorrection(signatureID int64, field, oldValue, newValue, correctedBy, reason string) *Correction {
+	return &Correction{SignatureID: signatureID,
+		Field:       field,
+		OldValue:    oldValue,
+		NewValue:    newValue,
+		CorrectedBy: correctedBy,
+		Reason:      reason,
+		Created:     time.Now()}
+}
+
+// NewAgreementTextCorrection creates a correction of one field of a signed agreement text.
+func NewAgreementTextCorrection(agreementTextID int64, field, oldValue, newValue, correctedBy, reason string) *Correction {
+	return &Correction{AgreementTextID: agreementTextID,
+		Field:       field,
+		OldValue:    oldValue,
+		NewValue:    newValue,
+		CorrectedBy: correctedBy,
+		Reason:      reason,
+		Created:     time.Now()}
+}
+
+// Store appends the correction. Corrections can't be changed once
+// stored, so Store returns ErrImmutable if the correction has an ID.
+func (correction *Correction) Store() (int64, error) {
+	if correction.ID != 0 {
+		return 0, ErrImmutable
+	}
+	if correction.CorrectedBy == "" || correction.Reason == "" {
+		return 0, errors.New("A correction must record who made it and why.")
+	}
+
+	err := db.QueryRow("INSERT INTO correction(signature_id,agreement_text_id,field,"+
+		"old_value,new_value,corrected_by,reason,created) "+
+		"VALUES(NULLIF($1,0),NULLIF($2,0),$3,$4,$5,$6,$7,$8) "+
+		"RETURNING id;",
+		correction.SignatureID,
+		correction.AgreementTextID,
+		correction.Field,
+		correction.OldValue,
+		correction.NewValue,
+		correction.CorrectedBy,
+		correction.Reason,
+		correction.Created).Scan(&correction.ID)
+	if err != nil {
+		return 0, err
+	}
+	return correction.ID, nil
+}
+
+// Corrections returns the corrections recorded against a signature
+// or agreement text, oldest first. Pass 0 for the ID which isn't used.
+func Corrections(signatureID, agreementTextID int64) ([]*Correction, error) {
+	rows, err := db.Query("SELECT id, COALESCE(signature_id, 0), COALESCE(agreement_text_id, 0), "+
+		"field, old_value, new_value, corrected_by, reason, created "+
+		"FROM correction "+
+		"WHERE signature_id = NULLIF($1,0) OR agreement_text_id = NULLIF($2,0) "+
+		"ORDER BY created, id;", signatureID, agreementTextID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	corrections := []*Correction{}
+	for rows.Next() {
+		correction := new(Correction)
+		err := rows.Scan(&correction.ID,
+			&correction.SignatureID,
+			&correction.AgreementTextID,
+			&correction.Field,
+			&correction.OldValue,
+			&correction.NewValue,
+			&correction.CorrectedBy,
+			&correction.Reason,
+			&correction.Created)
+		if err != nil {
+			return nil, err
+		}
+		corrections = append(corrections, correction)
+	}
+	return corrections, rows.Err()
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// NewAgreementTextTranslation creates a translation of an agreement text.
+func NewAgreementTextTranslation(agreementTextID int64, language string, title sql.NullString, content string) *AgreementTextTranslation {
+	return &AgreementTextTranslation{AgreementTextID: agreementTextID,
+		Language: language,
+		Title:    title,
+		Content:  content,
+		Created:  time.Now()}
+}
+
+// Store saves the translation. A zero ID inserts a new translation,
+// otherwise the existing translation is updated if its version in the
+// database still matches translation.Version. Once someone has signed
+// the text in the translation's language, Store returns ErrImmutable.
+func (translation *AgreementTextTranslation) Store() (int64, error) {
+	if translation.Language == "" {
+		return 0, errors.New("A translation must record its language.")
+	}
+
+	// Begin a transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var returnedID, returnedVersion int64
+
+	if translation.ID == 0 {
+		err = tx.QueryRow("INSERT INTO agreement_text_translation(agreement_text_id,language,"+
+			"title,content,created) "+
+			"VALUES($1,$2,$3,$4,$5) "+
+			"RETURNING id, version;",
+			translation.AgreementTextID,
+			translation.Language,
+			translation.Title,
+			translation.Content,
+			translation.Created).Scan(&returnedID, &returnedVersion)
+	} else {
+		// Signed translations are also protected by a trigger, but
+		// checking first gives a clearer error than a conflict.
+		var signed bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM signature "+
+			"WHERE signed_agreement_text_id = $1 AND language = $2);",
+			translation.AgreementTextID, translation.Language).Scan(&signed)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if signed {
+			tx.Rollback()
+			return 0, ErrImmutable
+		}
+
+		err = tx.QueryRow("UPDATE agreement_text_translation "+
+			"SET title = $1, content = $2, version = version + 1 "+
+			"WHERE id = $3 AND version = $4 "+
+			"RETURNING id, version;",
+			translation.Title,
+			translation.Content,
+			translation.ID,
+			translation.Version).Scan(&returnedID, &returnedVersion)
+		if err == sql.ErrNoRows {
+			err = ErrConflict
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return 0, immutableError(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, immutableError(err)
+	}
+
+	translation.ID = returnedID
+	translation.Version = returnedVersion
+	return returnedID, nil
+}
+
+const selectTranslation = "SELECT id, agreement_text_id, language, title, content, created, version " +
+	"FROM agreement_text_translation "
+
+func scanTranslation(row interface {
+	Scan(dest ...interface{}) error
+}) (*AgreementTextTranslation, error) {
+	translation := new(AgreementTextTranslation)
+	err := row.Scan(&translation.ID,
+		&translation.AgreementTextID,
+		&translation.Language,
+		&translation.Title,
+		&translation.Content,
+		&translation.Created,
+		&translation.Version)
+	if err != nil {
+		return nil, err
+	}
+	return translation, nil
+}
+
+// GetAgreementTextTranslation loads the translation of the agreement
+// text into the language. It returns sql.ErrNoRows if there isn't one.
+func GetAgreementTextTranslation(agreementTextID int64, language string) (*AgreementTextTranslation, error) {
+	return scanTranslation(db.QueryRow(selectTranslation+
+		"WHERE agreement_text_id = $1 AND language = $2;", agreementTextID, language))
+}
+
+// AgreementTextTranslations returns the translations of an agreement text, by language.
+func AgreementTextTranslations(agreementTextID int64) ([]*AgreementTextTranslation, error) {
+	rows, err := db.Query(selectTranslation+
+		"WHERE agreement_text_id = $1 "+
+		"ORDER BY language;", agreementTextID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := []*AgreementTextTranslation{}
+	for rows.Next() {
+		translation, err := scanTranslation(rows)
+		if err != nil {
+			return nil, err
+		}
+		translations = append(translations, translation)
+	}
+	return translations, rows.Err()
+}
+
+// Translate returns a copy of the text with the translation's language,
+// title and content.
+func (text *AgreementText) Translate(translation *AgreementTextTranslation) *AgreementText {
+	translated := *text
+	translated.Language = translation.Language
+	translated.Title = translation.Title
+	translated.Content = translation.Content
+	return &translated
+}
+
+// TextInLanguage returns the agreement text in the language, or the text
+// itself if it's already in the language or hasn't been translated into it.
+func TextInLanguage(text *AgreementText, language string) (*AgreementText, error) {
+	if text.Language == language {
+		return text, nil
+	}
+	translation, err := GetAgreementTextTranslation(text.ID, language)
+	if err == sql.ErrNoRows {
+		return text, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return text.Translate(translation), nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cu-library/signtwo/db"
+	"github.com/cu-library/signtwo/i18n"
+	"github.com/cu-library/signtwo/ldap"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/cu-library/signtwo/mail"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// The queue email is sent from, and the SMTP server it's sent through.
+// Both are nil if no SMTP server is configured, and no email is sent.
+var mailQueue *mail.Queue
+var smtpSender *mail.SMTP
+
+// startMailer sends email from a background queue, if an SMTP server is configured.
+func startMailer() error {
+	if *smtpServer == "" {
+		l.Log(l.InfoMessage, "No SMTP server is configured, so no email will be sent.")
+		return nil
+	}
+	sender, err := mail.NewSMTP(*smtpServer, *smtpUsername, *smtpPassword, *mailFrom)
+	if err != nil {
+		return err
+	}
+	queue := mail.NewQueue(sender, DefaultMailQueueSize, DefaultMailAttempts, DefaultMailBackoff)
+	queue.Observe = func(outcome string) {
+		emailsCounter.WithLabelValues(outcome).Inc()
+	}
+	smtpSender, mailQueue = sender, queue
+	startBackgroundJob("send email", queue.Run)
+	l.Logf(l.InfoMessage, "Sending email through %v.", *smtpServer)
+	return nil
+}
+
+// An emailTemplate is an email's subject and bodies, parsed once for
+// each language. The text template defines the subject, and its body
+// is the plain text body. The HTML template is the HTML alternative.
+type emailTemplate struct {
+	text map[string]*texttemplate.Template
+	html map[string]*template.Template
+}
+
+var (
+	signedEmailTemplate       *emailTemplate
+	signedNoticeEmailTemplate *emailTemplate
+	reminderEmailTemplate     *emailTemplate
+)
+
+// The email templates, each parsed from its name.txt.tmpl and
+// name.html.tmpl files in the templates/email directory.
+var emailTemplates = []struct {
+	tmpl **emailTemplate
+	name string
+}{
+	{&signedEmailTemplate, "signed"},
+	{&signedNoticeEmailTemplate, "signednotice"},
+	{&reminderEmailTemplate, "reminder"},
+}
+
+// parseEmailTemplates parses the email templates in the assets, once
+// for each language. A theme's templates/email files override the
+// blocks they define, like the page templates.
+func parseEmailTemplates(assets fs.FS, theme fs.FS) ([]*emailTemplate, error) {
+	parsed := make([]*emailTemplate, len(emailTemplates))
+	for i, email := range emailTemplates {
+		parsed[i] = &emailTemplate{text: map[string]*texttemplate.Template{}, html: map[string]*template.Template{}}
+		textFile, htmlFile := "email/"+email.name+".txt.tmpl", "email/"+email.name+".html.tmpl"
+
+		for _, language := range i18n.Languages() {
+			funcs := localizedFuncs(language)
+			text, err := texttemplate.New(email.name+".txt.tmpl").Funcs(texttemplate.FuncMap(funcs)).
+				ParseFS(assets, "templates/"+textFile)
+			if err != nil {
+				return nil, err
+			}
+			if found, err := themeHas(theme, textFile); err != nil {
+				return nil, err
+			} else if found {
+				text, err = text.ParseFS(theme, "templates/"+textFile)
+				if err != nil {
+					return nil, err
+				}
+			}
+			parsed[i].text[language] = text
+
+			html, err := template.New(email.name+".html.tmpl").Funcs(funcs).ParseFS(assets, "templates/"+htmlFile)
+			if err != nil {
+				return nil, err
+			}
+			parsed[i].html[language], err = parseOverride(html, theme, htmlFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// Render returns the email in the language, or in the default language.
+func (tmpl *emailTemplate) Render(language string, data interface{}) (*mail.Message, error) {
+	assetsMutex.RLock()
+	defer assetsMutex.RUnlock()
+
+	if _, ok := tmpl.text[language]; !ok {
+		language = i18n.DefaultLanguage
+	}
+	subject, body := new(bytes.Buffer), new(bytes.Buffer)
+	err := tmpl.text[language].ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+	err = tmpl.text[language].Execute(body, data)
+	if err != nil {
+		return nil, err
+	}
+	html := new(bytes.Buffer)
+	err = tmpl.html[language].Execute(html, data)
+	if err != nil {
+		return nil, err
+	}
+	return &mail.Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(body.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
+
+// queueEmail renders the email in the language and queues it to be
+// sent to the recipient. Nothing is sent if email isn't configured.
+// Failures are logged, since the email shouldn't stop the request.
+func queueEmail(logger l.Logger, recipient string, tmpl *emailTemplate, language string, data interface{}) {
+	if mailQueue == nil {
+		return
+	}
+	msg, err := tmpl.Render(language, data)
+	if err != nil {
+		logger.Logf(l.ErrorMessage, "Unable to render an email to %v: %v", recipient, err)
+		return
+	}
+	msg.To = []string{recipient}
+	err = mailQueue.Enqueue(msg)
+	if err != nil {
+		logger.Logf(l.ErrorMessage, "Unable to queue the email %q to %v: %v", msg.Subject, recipient, err)
+	}
+}
+
+// siteLink returns the absolute url of a named route, or an empty
+// string if -siteurl isn't set.
+func siteLink(name string, pairs ...interface{}) string {
+	if *siteURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(*siteURL, "/") + urlFor(name, pairs...)
+}
+
+// The details of a signature, shown in the confirmation and the notice to owners.
+type signedEmail struct {
+	AgreementTitle     string
+	TextTitle          string
+	TextID             int64
+	Language           string
+	Username           string
+	FirstName          string
+	LastName           string
+	SignedTimestampUTC time.Time
+	ContentSHA256      string
+
+	// Links, which are empty if -siteurl isn't set.
+	AgreementURL  string
+	ReceiptURL    string
+	SignaturesURL string
+}
+
+// sendSignatureEmails emails a confirmation to the person who signed,
+// in the language they signed in, and a notice to the agreement's
+// owners who asked for one, in the default language. The text is the
+// version which was signed, in the language it was signed in.
+// The owners are looked up in the directory in the background, so a
+// slow directory doesn't hold up the signer.
+func sendSignatureEmails(r *http.Request, agreement *db.Agreement, text *db.AgreementText, signature *db.Signature) {
+	if mailQueue == nil {
+		return
+	}
+	data := &signedEmail{
+		AgreementTitle:     agreement.Title,
+		TextTitle:          text.Title.String,
+		TextID:             text.ID,
+		Language:           i18n.Name(signature.Language),
+		Username:           signature.Username,
+		FirstName:          signature.FirstName,
+		LastName:           signature.LastName,
+		SignedTimestampUTC: signature.SignedTimestampUTC,
+		ContentSHA256:      signature.ContentSHA256,
+		AgreementURL:       siteLink("agreement", "id", agreement.ID),
+		ReceiptURL:         siteLink("receipt", "id", signature.ID),
+		SignaturesURL:      siteLink("signatures", "id", agreement.ID),
+	}
+
+	if signature.Email == "" {
+		logFor(r).Logf(l.WarnMessage, "No confirmation was sent for signature %v, as %v has no email address.",
+			signature.ID, signature.Username)
+	} else {
+		queueEmail(logFor(r), signature.Email, signedEmailTemplate, signature.Language, data)
+	}
+
+	owners, err := db.NotifiedOwners(agreement.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the owners of agreement %v to notify: %v", agreement.ID, err)
+		return
+	}
+	if len(owners) == 0 {
+		return
+	}
+	logger := logFor(r)
+	startBackgroundJob(fmt.Sprintf("notify the owners of signature %v", signature.ID), func(ctx context.Context) {
+		notifyOwners(ctx, logger, owners, signature, data)
+	})
+}
+
+// notifyOwners emails the notice of a signature to each owner with an
+// email address in the directory, stopping early at shutdown.
+func notifyOwners(ctx context.Context, logger l.Logger, owners []string, signature *db.Signature, data *signedEmail) {
+	for _, username := range owners {
+		if ctx.Err() != nil {
+			logger.Logf(l.WarnMessage, "Shut down before every owner was sent a notice of signature %v.", signature.ID)
+			return
+		}
+		owner, err := ldap.Lookup(username)
+		if err != nil {
+			logger.Logf(l.ErrorMessage, "Unable to look up %v, an owner to notify of signature %v, in the directory: %v",
+				username, signature.ID, err)
+			continue
+		}
+		if owner.Email == "" {
+			logger.Logf(l.WarnMessage, "No notice of signature %v was sent to %v, as they have no email address.",
+				signature.ID, username)
+			continue
+		}
+		queueEmail(logger, owner.Email, signedNoticeEmailTemplate, i18n.DefaultLanguage, data)
+	}
+}
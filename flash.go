@@ -0,0 +1,116 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/cu-library/signtwo/i18n"
+	"github.com/cu-library/signtwo/keyring"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/gorilla/securecookie"
+	"net/http"
+	"time"
+)
+
+// The cookie which carries a flash message to the next page.
+const FlashCookieName = "flash"
+
+// How long a flash message waits to be shown.
+const flashLength = 5 * time.Minute
+
+// The kinds of flash message.
+const (
+	FlashSuccess = "success"
+	FlashInfo    = "info"
+	FlashError   = "error"
+)
+
+// A flash is a message shown once, on the page after a redirect.
+// The message is English, and translated when it's shown.
+type flash struct {
+	Kind    string
+	Message string
+	Args    []string
+}
+
+// flashCodecs returns codecs for the flash cookie.
+func flashCodecs() []securecookie.Codec {
+	return signingCodecs((*keyring.Key).FlashKey, flashLength)
+}
+
+// signingCodecs returns codecs which sign values with a key derived by
+// derive, one for each accepted key, newest first. Values are signed
+// with the newest key, and are accepted for the length of time.
+func signingCodecs(derive func(*keyring.Key) []byte, length time.Duration) []securecookie.Codec {
+	now := time.Now()
+	codecs := []securecookie.Codec{}
+	secrets := currentSecrets()
+	if secrets == nil {
+		return codecs
+	}
+	for _, key := range secrets.Keys {
+		if key.Retired(now) {
+			continue
+		}
+		codec := securecookie.New(derive(key), nil)
+		codec.MaxAge(int(length / time.Second))
+		codec.SetSerializer(securecookie.JSONEncoder{})
+		codecs = append(codecs, codec)
+	}
+	return codecs
+}
+
+// setFlash stores a message to show on the next page the user sees.
+// Arguments are formatted into the translated message.
+func setFlash(w http.ResponseWriter, r *http.Request, kind, message string, args ...string) {
+	encoded, err := securecookie.EncodeMulti(FlashCookieName, &flash{kind, message, args}, flashCodecs()...)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to encode a flash message: %v", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     FlashCookieName,
+		Value:    encoded,
+		Path:     cookiePath(),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		Expires:  time.Now().Add(flashLength),
+	})
+}
+
+// A shownFlash is a flash message, translated for the page.
+type shownFlash struct {
+	Kind    string
+	Message string
+}
+
+// takeFlash returns the request's flash message, translated into its
+// language, and clears it so it's only shown once. It returns nil if
+// there's no valid message.
+func takeFlash(w http.ResponseWriter, r *http.Request) *shownFlash {
+	cookie, err := r.Cookie(FlashCookieName)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     FlashCookieName,
+		Value:    "",
+		Path:     cookiePath(),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		MaxAge:   -1,
+	})
+
+	stored := new(flash)
+	err = securecookie.DecodeMulti(FlashCookieName, cookie.Value, stored, flashCodecs()...)
+	if err != nil {
+		logFor(r).Logf(l.DebugMessage, "Ignoring an invalid flash message: %v", err)
+		return nil
+	}
+	args := make([]interface{}, len(stored.Args))
+	for i, arg := range stored.Args {
+		args[i] = arg
+	}
+	return &shownFlash{Kind: stored.Kind, Message: i18n.Translate(languageFor(r), stored.Message, args...)}
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cu-library/signtwo/db"
+	"github.com/cu-library/signtwo/ldap"
+	l "github.com/cu-library/signtwo/loglevel"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a readiness result is reused, so frequent
+	// probes don't reach the database and directory each time.
+	DefaultReadinessCacheLength = 5 * time.Second
+
+	// How long a dependency has to answer a readiness probe.
+	DefaultReadinessTimeout = 3 * time.Second
+)
+
+// The status of one dependency. The probes are public, so the error is
+// only logged, as it can describe the database and directory servers.
+type dependencyStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"-"`
+}
+
+// The body of the health and readiness responses.
+type healthStatus struct {
+	Status       string                      `json:"status"`
+	Checked      time.Time                   `json:"checked"`
+	Dependencies map[string]dependencyStatus `json:"dependencies,omitempty"`
+}
+
+// The dependencies checked for readiness.
+var readinessChecks = map[string]func(ctx context.Context) error{
+	"database": db.Ping,
+	"ldap": func(ctx context.Context) error {
+		return ldap.Ping()
+	},
+}
+
+var readinessMutex sync.Mutex
+var lastReadiness *healthStatus
+
+// checkDependency runs the check, timing it and giving up after the timeout.
+func checkDependency(check func(ctx context.Context) error) dependencyStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultReadinessTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	status := dependencyStatus{Status: "ok", LatencyMS: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		status.Status = "unavailable"
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// readiness checks each dependency concurrently, or returns the
+// previous result if it is recent enough.
+func readiness(now time.Time) *healthStatus {
+	readinessMutex.Lock()
+	defer readinessMutex.Unlock()
+
+	if lastReadiness != nil && now.Sub(lastReadiness.Checked) < DefaultReadinessCacheLength {
+		return lastReadiness
+	}
+
+	result := &healthStatus{Status: "ok", Checked: now, Dependencies: map[string]dependencyStatus{}}
+	var resultMutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range readinessChecks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			status := checkDependency(check)
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			result.Dependencies[name] = status
+			if status.Status != "ok" {
+				l.Logf(l.WarnMessage, "Readiness check of %v failed: %v", name, status.Error)
+				result.Status = "unavailable"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	lastReadiness = result
+	return result
+}
+
+// writeHealthStatus writes the status as JSON, with 503 Service Unavailable
+// if it isn't ok.
+func writeHealthStatus(w http.ResponseWriter, status *healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		l.Logf(l.ErrorMessage, "Unable to write health status: %v", err)
+	}
+}
+
+// The process is alive if it can answer.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Healthz Handler visited.")
+	writeHealthStatus(w, &healthStatus{Status: "ok", Checked: time.Now().UTC()})
+}
+
+// The process is ready if it can reach the database and the directory.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Readyz Handler visited.")
+	writeHealthStatus(w, readiness(time.Now().UTC()))
+}
+
+// exemptFromCSRF serves the health and readiness probes, the metrics,
+// and unsubscribe posts directly from the router, without the CSRF
+// protection, and everything else through next. Mail clients post to
+// unsubscribe links without a CSRF token; the link's signed token
+// stands in for it.
+func exemptFromCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == urlFor("healthz"), r.URL.Path == urlFor("readyz"), r.URL.Path == urlFor("metrics"),
+			r.URL.Path == urlFor("unsubscribe") && r.Method == http.MethodPost:
+			router.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
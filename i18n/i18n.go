@@ -0,0 +1,172 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Provides message catalogs for the user interface, and
+// chooses a language from a user's preferences.
+//
+// Messages are identified by their English text. Each catalog in the
+// catalogs directory, named after its language, maps English messages
+// to their translation. A message missing from a catalog is shown in English.
+package i18n
+
+import (
+	"embed"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The language messages are written in.
+const DefaultLanguage = "en"
+
+//go:embed catalogs/*.yaml
+var embeddedCatalogs embed.FS
+
+// A Catalog maps English messages to their translation.
+type Catalog map[string]string
+
+// The catalog of each language, except the default.
+var catalogs = map[string]Catalog{}
+
+func init() {
+	loaded, err := LoadCatalogs(embeddedCatalogs, "catalogs")
+	if err != nil {
+		panic(err)
+	}
+	catalogs = loaded
+}
+
+// LoadCatalogs reads the catalogs in the directory of fsys. Each is a
+// YAML mapping of English messages to their translation, named for its
+// language, like fr.yaml.
+func LoadCatalogs(fsys fs.FS, dir string) (map[string]Catalog, error) {
+	names, err := fs.Glob(fsys, path.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string]Catalog{}
+	for _, name := range names {
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		catalog := Catalog{}
+		err = yaml.Unmarshal(content, &catalog)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse message catalog %v: %v", name, err)
+		}
+		loaded[strings.TrimSuffix(path.Base(name), ".yaml")] = catalog
+	}
+	return loaded, nil
+}
+
+// Languages returns the languages messages can be shown in,
+// the default language first.
+func Languages() []string {
+	languages := []string{}
+	for language := range catalogs {
+		if language != DefaultLanguage {
+			languages = append(languages, language)
+		}
+	}
+	sort.Strings(languages)
+	return append([]string{DefaultLanguage}, languages...)
+}
+
+// Supported reports whether messages can be shown in the language.
+func Supported(language string) bool {
+	_, ok := catalogs[language]
+	return ok || language == DefaultLanguage
+}
+
+// Translate returns the message in the language, formatted with the
+// arguments like fmt.Sprintf if there are any.
+func Translate(language, message string, args ...interface{}) string {
+	if translated, ok := catalogs[language][message]; ok && translated != "" {
+		message = translated
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+// Has reports whether the language's catalog translates the message.
+func Has(language, message string) bool {
+	_, ok := catalogs[language][message]
+	return ok
+}
+
+// A preference is a language range from Accept-Language and its weight.
+type preference struct {
+	language string
+	q        float64
+}
+
+// ParseAcceptLanguage returns the language ranges in an Accept-Language
+// header, most preferred first. Ranges with a weight of zero are left out.
+func ParseAcceptLanguage(header string) []string {
+	preferences := []preference{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		language := strings.ToLower(strings.TrimSpace(fields[0]))
+		if language == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		if q > 0 {
+			preferences = append(preferences, preference{language, q})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool {
+		return preferences[i].q > preferences[j].q
+	})
+
+	languages := make([]string, len(preferences))
+	for i, p := range preferences {
+		languages[i] = p.language
+	}
+	return languages
+}
+
+// Match returns the first of the preferred languages which is supported,
+// matching a regional variant like fr-CA to its language. It returns
+// the default language if none are supported.
+func Match(preferred ...string) string {
+	for _, language := range preferred {
+		language = strings.ToLower(strings.TrimSpace(language))
+		if Supported(language) {
+			return language
+		}
+		if base := strings.SplitN(language, "-", 2)[0]; Supported(base) {
+			return base
+		}
+	}
+	return DefaultLanguage
+}
+
+// Name returns the name of the language, in that language.
+func Name(language string) string {
+	if name, ok := catalogs[language]["English"]; ok {
+		return name
+	}
+	if language == DefaultLanguage {
+		return "English"
+	}
+	return language
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package i18n
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+
+	headerToExpected := map[string][]string{
+		"":                          {},
+		"fr-CA":                     {"fr-ca"},
+		"en-US,en;q=0.9,fr;q=0.95":  {"en-us", "fr", "en"},
+		"de;q=0, fr;q=0.5, *;q=0.1": {"fr", "*"},
+		"fr;q=bad, en":              {"en"},
+	}
+	for header, expected := range headerToExpected {
+		if parsed := ParseAcceptLanguage(header); !reflect.DeepEqual(parsed, expected) {
+			t.Errorf("Parsed %q as %q, expected %q", header, parsed, expected)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+
+	for _, c := range []struct {
+		preferences []string
+		expected    string
+	}{
+		{[]string{"fr-CA", "en"}, "fr"},
+		{[]string{"de", "en-GB"}, "en"},
+		{[]string{"de", "*"}, DefaultLanguage},
+		{nil, DefaultLanguage},
+	} {
+		if matched := Match(c.preferences...); matched != c.expected {
+			t.Errorf("Matched %q to %v, expected %v", c.preferences, matched, c.expected)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+
+	if translated := Translate("fr", "Log in"); translated == "Log in" {
+		t.Error("The French catalog doesn't translate \"Log in\".")
+	}
+	if translated := Translate("fr", "A message nobody translated"); translated != "A message nobody translated" {
+		t.Errorf("A missing translation became %q", translated)
+	}
+	if translated := Translate("en", "Agreements owned by %v", "jdoe"); translated != "Agreements owned by jdoe" {
+		t.Errorf("Formatting the message gave %q", translated)
+	}
+	if Languages()[0] != DefaultLanguage || !Supported("fr") || Supported("de") {
+		t.Errorf("Unexpected languages %v", Languages())
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package keyring parses the set of secret keys used to sign session
+// tokens and CSRF cookies. Keys have IDs, so a new key can be added
+// while older keys are still accepted until their retirement date.
+//
+// A keyring is written as a list of keys separated by commas or newlines,
+// newest first. Each key is an ID, an equals sign, and 160 bytes of hex,
+// optionally followed by @ and the date the key retires:
+//
+//	2026b=4f1c...,2026a=9a0e...@2026-11-01
+//
+// IDs are made of letters, digits, hyphens and underscores, as they are
+// used in cookie names and token headers. A single key without an ID has
+// the ID "default".
+package keyring
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The length of each key, in bytes.
+const KeyLength = 160
+
+// The length of the part of each key used for CSRF cookies. The rest is used for session tokens.
+const CSRFKeyLength = 32
+
+// The ID of a key written without one.
+const DefaultID = "default"
+
+// The layout of retirement dates.
+const DateLayout = "2006-01-02"
+
+type Key struct {
+	ID      string
+	Secret  []byte
+	Retires time.Time
+}
+
+// CSRFKey returns the part of the key used for CSRF cookies.
+func (key *Key) CSRFKey() []byte {
+	return key.Secret[:CSRFKeyLength]
+}
+
+// JWTKey returns the part of the key used for session tokens.
+func (key *Key) JWTKey() []byte {
+	return key.Secret[CSRFKeyLength:]
+}
+
+// FlashKey returns a key for signing flash message cookies, derived
+// from the session token part, so no token can be forged from one.
+func (key *Key) FlashKey() []byte {
+	return key.derive("flash")
+}
+
+// UnsubscribeKey returns a key for signing the unsubscribe links in
+// reminder emails, derived like the flash key.
+func (key *Key) UnsubscribeKey() []byte {
+	return key.derive("unsubscribe")
+}
+
+func (key *Key) derive(purpose string) []byte {
+	mac := hmac.New(sha256.New, key.JWTKey())
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Retired reports whether the key is no longer accepted at the given time.
+func (key *Key) Retired(now time.Time) bool {
+	return !key.Retires.IsZero() && !now.Before(key.Retires)
+}
+
+// A Keyring is a list of keys, newest first.
+type Keyring struct {
+	Keys []*Key
+}
+
+// Parse parses a keyring.
+func Parse(value string) (*Keyring, error) {
+	entries := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+
+	keyring := new(Keyring)
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key := &Key{ID: DefaultID}
+		if i := strings.Index(entry, "@"); i != -1 {
+			retires, err := time.Parse(DateLayout, entry[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse the retirement date of key %q: %v", entry[:i], err)
+			}
+			key.Retires = retires
+			entry = entry[:i]
+		}
+		if i := strings.Index(entry, "="); i != -1 {
+			key.ID = entry[:i]
+			entry = entry[i+1:]
+		}
+		if key.ID == "" {
+			return nil, errors.New("A key has an empty ID.")
+		}
+		if strings.IndexFunc(key.ID, invalidIDRune) != -1 {
+			return nil, fmt.Errorf("The key ID %q may only contain letters, digits, hyphens and underscores.", key.ID)
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("The key ID %q is used more than once.", key.ID)
+		}
+		seen[key.ID] = true
+
+		secret, err := hex.DecodeString(entry)
+		if err != nil || len(secret) != KeyLength {
+			return nil, fmt.Errorf("Unable to parse key %q, it must be %v bytes of hex.", key.ID, KeyLength)
+		}
+		key.Secret = secret
+		keyring.Keys = append(keyring.Keys, key)
+	}
+
+	if len(keyring.Keys) == 0 {
+		return nil, errors.New("The keyring has no keys.")
+	}
+	return keyring, nil
+}
+
+func invalidIDRune(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+}
+
+// Newest returns the key new tokens and cookies are signed with.
+func (keyring *Keyring) Newest() *Key {
+	return keyring.Keys[0]
+}
+
+// Accepted returns the key with the ID, if it hasn't retired.
+func (keyring *Keyring) Accepted(id string, now time.Time) (*Key, bool) {
+	for _, key := range keyring.Keys {
+		if key.ID == id {
+			return key, !key.Retired(now)
+		}
+	}
+	return nil, false
+}
+
+// Generate creates a new key, with an ID based on today's date,
+// written the way Parse expects.
+func Generate(now time.Time) (string, error) {
+	secret := make([]byte, KeyLength)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 2)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("%v-%v", now.UTC().Format("20060102"), hex.EncodeToString(suffix))
+	return fmt.Sprintf("%v=%v", id, hex.EncodeToString(secret)), nil
+}
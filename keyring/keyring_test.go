@@ -0,0 +1,93 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package keyring
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	hexA = strings.Repeat("0a", KeyLength)
+	hexB = strings.Repeat("0b", KeyLength)
+)
+
+func TestParseSingleKeyWithoutID(t *testing.T) {
+	keyring, err := Parse(hexA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring.Keys) != 1 || keyring.Newest().ID != DefaultID {
+		t.Error("A single key without an ID wasn't given the default ID.")
+	}
+	if len(keyring.Newest().CSRFKey()) != CSRFKeyLength || len(keyring.Newest().JWTKey()) != KeyLength-CSRFKeyLength {
+		t.Error("Key wasn't split into CSRF and JWT keys.")
+	}
+	if flashKey := keyring.Newest().FlashKey(); len(flashKey) != 32 || bytes.Contains(keyring.Newest().Secret, flashKey) {
+		t.Error("The flash key isn't derived from the key.")
+	}
+	if unsubscribeKey := keyring.Newest().UnsubscribeKey(); len(unsubscribeKey) != 32 || bytes.Equal(unsubscribeKey, keyring.Newest().FlashKey()) {
+		t.Error("The unsubscribe key isn't derived separately from the key.")
+	}
+}
+
+func TestParseRotation(t *testing.T) {
+	keyring, err := Parse("new=" + hexB + ",\nold=" + hexA + "@2015-10-01\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.Newest().ID != "new" {
+		t.Error("The first key isn't the newest.")
+	}
+
+	before := time.Date(2015, 9, 30, 23, 0, 0, 0, time.UTC)
+	after := time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)
+	if _, ok := keyring.Accepted("old", before); !ok {
+		t.Error("Old key wasn't accepted before its retirement date.")
+	}
+	if _, ok := keyring.Accepted("old", after); ok {
+		t.Error("Old key was accepted on its retirement date.")
+	}
+	if _, ok := keyring.Accepted("new", after); !ok {
+		t.Error("Key without a retirement date wasn't accepted.")
+	}
+	if _, ok := keyring.Accepted("unknown", before); ok {
+		t.Error("Unknown key was accepted.")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := []string{
+		"",
+		"abcd",
+		"a=" + hexA + ",a=" + hexB,
+		"=" + hexA,
+		"a=" + hexA + "@tomorrow",
+		"a;b=" + hexA,
+		"a b=" + hexA,
+		"é=" + hexA,
+	}
+	for _, value := range bad {
+		if _, err := Parse(value); err == nil {
+			t.Errorf("Parsed the bad keyring %q.", value)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	generated, err := Generate(time.Date(2015, 9, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := Parse(generated)
+	if err != nil {
+		t.Fatalf("Unable to parse a generated key: %v", err)
+	}
+	if !strings.HasPrefix(keyring.Newest().ID, "20150901-") {
+		t.Errorf("Generated key has an unexpected ID %v.", keyring.Newest().ID)
+	}
+}
@@ -6,18 +6,79 @@ package ldap
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	l "github.com/cu-library/signtwo/loglevel"
 	"github.com/mavricknz/ldap"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// The directory attributes read when looking up a person.
+const (
+	UsernameAttribute   = "sAMAccountName"
+	FirstNameAttribute  = "givenName"
+	LastNameAttribute   = "sn"
+	EmailAttribute      = "mail"
+	DepartmentAttribute = "department"
+	UserTypeAttribute   = "employeeType"
+	BannerIDAttribute   = "employeeID"
+
+	PreferredLanguageAttribute = "preferredLanguage"
+)
+
+// A Person is a user's details, as recorded in the directory.
+type Person struct {
+	DN         string
+	Username   string
+	FirstName  string
+	LastName   string
+	Email      string
+	Department string
+	UserType   string
+	BannerID   int64
+
+	// The language the person prefers, like fr or en-CA, if recorded.
+	PreferredLanguage string
+}
+
+// Observe, if set, is called after each bind and search with how long
+// it took and its error, if any. Binds as a user are "user bind", so
+// wrong passwords can be told apart from a failing service account.
+var Observe func(operation string, duration time.Duration, err error)
+
+func observe(operation string, start time.Time, err error) {
+	if Observe != nil {
+		Observe(operation, time.Since(start), err)
+	}
+}
+
+// The package's messages use the ldap component's log level.
+var logger = l.For(l.LDAP)
+
 var conn *ldap.LDAPConnection
+var searchBaseDN string
+
+// Searches share the connection, but a rebind needs it to itself.
+var connMutex = new(sync.RWMutex)
+
+// The resolved server, used to open a separate connection for each user bind.
+var serverHostname string
+var serverPort uint16
+var serverTLSConfig *tls.Config
+
+// debugEnabled reports whether the LDAP library should log its protocol
+// messages, which it does at the ldap component's DEBUG level and above.
+func debugEnabled() bool {
+	return l.Enabled(l.LDAP, l.DebugMessage)
+}
 
-func Connect(server string, port int, username string, password string, loglevel l.LogLevel) error {
+func Connect(server string, port int, username string, password string, baseDN string) error {
 
-	l.Log(l.InfoMessage, "Connecting to LDAP...")
+	logger.Log(l.InfoMessage, "Connecting to LDAP...")
 
 	// The next block of code resolves the LDAP servers to one server.
 	ips, err := net.LookupIP(server)
@@ -33,11 +94,11 @@ func Connect(server string, port int, username string, password string, loglevel
 	tlsConfig := &tls.Config{ServerName: hostname}
 	conn = ldap.NewLDAPSSLConnection(hostname, uint16(port), tlsConfig)
 
-	debug := false
-	if loglevel == l.DebugMessage || loglevel == l.TraceMessage {
-		debug = true
-	}
-	conn.Debug = debug
+	serverHostname = hostname
+	serverPort = uint16(port)
+	serverTLSConfig = tlsConfig
+
+	conn.Debug = debugEnabled()
 	conn.NetworkConnectTimeout = time.Second * 10
 
 	err = conn.Connect()
@@ -45,17 +106,240 @@ func Connect(server string, port int, username string, password string, loglevel
 		return fmt.Errorf("Unable to connect to LDAP server at %v before 10 seconds: %v", hostname, err)
 	}
 
+	start := time.Now()
 	err = conn.Bind(username, password)
+	observe("bind", start, err)
 	if err != nil {
 		return fmt.Errorf("Unable to bind to LDAP server at %v using credentials: %v", hostname, err)
 	}
 
-	l.Log(l.InfoMessage, "Successful LDAP connection and BIND")
+	searchBaseDN = baseDN
+
+	// Follow changes to the log level, so debugging can be turned on
+	// without reconnecting.
+	l.OnChange(func() {
+		debug := debugEnabled()
+		connMutex.Lock()
+		defer connMutex.Unlock()
+		if conn.Debug != debug {
+			conn.Debug = debug
+			logger.Logf(l.InfoMessage, "LDAP debugging set to %v.", debug)
+		}
+	})
+
+	logger.Log(l.InfoMessage, "Successful LDAP connection and BIND")
+	return nil
+}
+
+// Rebind binds the shared connection again with new service account credentials.
+func Rebind(username, password string) error {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+
+	start := time.Now()
+	err := conn.Bind(username, password)
+	observe("bind", start, err)
+	if err != nil {
+		return fmt.Errorf("Unable to bind to LDAP server at %v using credentials: %v", serverHostname, err)
+	}
+	logger.Log(l.InfoMessage, "Successful LDAP BIND with new credentials")
 	return nil
 }
 
+// The attributes read for each person.
+var personAttributes = []string{
+	UsernameAttribute,
+	FirstNameAttribute,
+	LastNameAttribute,
+	EmailAttribute,
+	DepartmentAttribute,
+	UserTypeAttribute,
+	BannerIDAttribute,
+	PreferredLanguageAttribute,
+}
+
+// How many entries the server returns at a time when searching for people.
+const searchPageSize = 500
+
+// Lookup finds a person in the directory by their username.
+func Lookup(username string) (*Person, error) {
+	filter := fmt.Sprintf("(%v=%v)", UsernameAttribute, escapeFilterValue(username))
+	request := ldap.NewSimpleSearchRequest(searchBaseDN, ldap.ScopeWholeSubtree, filter, personAttributes)
+
+	connMutex.RLock()
+	start := time.Now()
+	result, err := conn.Search(request)
+	observe("search", start, err)
+	connMutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to search for %v: %v", username, err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("Expected one directory entry for %v, found %v", username, len(result.Entries))
+	}
+
+	return personFromEntry(result.Entries[0])
+}
+
+// personFromEntry reads a person's details from their directory entry.
+func personFromEntry(entry *ldap.Entry) (*Person, error) {
+	var err error
+	person := &Person{
+		DN:         entry.DN,
+		Username:   entry.GetAttributeValue(UsernameAttribute),
+		FirstName:  entry.GetAttributeValue(FirstNameAttribute),
+		LastName:   entry.GetAttributeValue(LastNameAttribute),
+		Email:      entry.GetAttributeValue(EmailAttribute),
+		Department: entry.GetAttributeValue(DepartmentAttribute),
+		UserType:   entry.GetAttributeValue(UserTypeAttribute),
+
+		PreferredLanguage: entry.GetAttributeValue(PreferredLanguageAttribute),
+	}
+	if bannerID := entry.GetAttributeValue(BannerIDAttribute); bannerID != "" {
+		person.BannerID, err = strconv.ParseInt(bannerID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse the Banner ID of %v: %v", person.Username, err)
+		}
+	}
+	return person, nil
+}
+
+// Search finds the people matching the filter, a search filter as
+// described in RFC 4515. Entries without a username aren't people,
+// and are left out.
+func Search(filter string) ([]*Person, error) {
+	filter = fmt.Sprintf("(&%v(%v=*))", filter, UsernameAttribute)
+	request := ldap.NewSimpleSearchRequest(searchBaseDN, ldap.ScopeWholeSubtree, filter, personAttributes)
+
+	connMutex.RLock()
+	start := time.Now()
+	result, err := conn.SearchWithPaging(request, searchPageSize)
+	observe("search", start, err)
+	connMutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to search for %v: %v", filter, err)
+	}
+
+	people := []*Person{}
+	for _, entry := range result.Entries {
+		person, err := personFromEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		people = append(people, person)
+	}
+	return people, nil
+}
+
+// GroupFilter returns a filter matching the members of the group, and
+// of the groups nested in it, by the group's DN.
+func GroupFilter(groupDN string) string {
+	// LDAP_MATCHING_RULE_IN_CHAIN follows nested group memberships.
+	return fmt.Sprintf("(memberOf:1.2.840.113556.1.4.1941:=%v)", escapeFilterValue(groupDN))
+}
+
+// UserTypeFilter returns a filter matching people of any of the user types.
+func UserTypeFilter(userTypes []string) string {
+	var filter strings.Builder
+	filter.WriteString("(|")
+	for _, userType := range userTypes {
+		fmt.Fprintf(&filter, "(%v=%v)", UserTypeAttribute, escapeFilterValue(userType))
+	}
+	filter.WriteString(")")
+	return filter.String()
+}
+
+// CheckFilter returns an error if the filter obviously isn't a search
+// filter: it must be in parentheses, and its parentheses must balance.
+// The server checks the rest when it's used.
+func CheckFilter(filter string) error {
+	if !strings.HasPrefix(filter, "(") || !strings.HasSuffix(filter, ")") {
+		return errors.New("A filter must be in parentheses.")
+	}
+	depth := 0
+	for i, c := range filter {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth < 0 || (depth == 0 && i != len(filter)-1) {
+			return errors.New("A filter's parentheses must balance.")
+		}
+	}
+	if depth != 0 {
+		return errors.New("A filter's parentheses must balance.")
+	}
+	return nil
+}
+
+// Authenticate checks the user's password by binding as them. It
+// returns the person's directory details if the password is correct.
+func Authenticate(username, password string) (*Person, error) {
+	// An empty password would be an unauthenticated bind, which succeeds.
+	if password == "" {
+		return nil, errors.New("A password is required.")
+	}
+
+	person, err := Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bind on a separate connection, so the service account's bind
+	// on the shared connection isn't replaced.
+	userConn := ldap.NewLDAPSSLConnection(serverHostname, serverPort, serverTLSConfig)
+	userConn.NetworkConnectTimeout = time.Second * 10
+	userConn.Debug = debugEnabled()
+	err = userConn.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to LDAP server at %v: %v", serverHostname, err)
+	}
+	defer userConn.Close()
+
+	start := time.Now()
+	err = userConn.Bind(person.DN, password)
+	observe("user bind", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to bind as %v: %v", username, err)
+	}
+	return person, nil
+}
+
+// Ping checks that the directory can be searched, by reading
+// the base DN entry over the shared connection.
+func Ping() error {
+	request := ldap.NewSimpleSearchRequest(searchBaseDN, ldap.ScopeBaseObject, "(objectClass=*)", []string{"1.1"})
+
+	connMutex.RLock()
+	start := time.Now()
+	_, err := conn.Search(request)
+	observe("search", start, err)
+	connMutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("Unable to search LDAP server at %v: %v", serverHostname, err)
+	}
+	return nil
+}
+
+// escapeFilterValue escapes the special characters in a value
+// used in a search filter, as described in RFC 4515.
+func escapeFilterValue(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&escaped, "\\%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
 func Close() {
-	l.Log(l.TraceMessage, "Closing ldap connection...")
+	logger.Log(l.TraceMessage, "Closing ldap connection...")
 	conn.Close()
-	l.Log(l.TraceMessage, "Successfully closed ldap connection.")	
+	logger.Log(l.TraceMessage, "Successfully closed ldap connection.")	
 }
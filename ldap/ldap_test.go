@@ -0,0 +1,52 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package ldap
+
+import (
+	"testing"
+)
+
+func TestEscapeFilterValue(t *testing.T) {
+
+	valueToEscaped := map[string]string{
+		"jsmith":     "jsmith",
+		"*":          "\\2a",
+		"j*)(uid=*":  "j\\2a\\29\\28uid=\\2a",
+		"back\\side": "back\\5cside",
+		"nul\x00":    "nul\\00",
+	}
+
+	for value, expected := range valueToEscaped {
+		if escaped := escapeFilterValue(value); escaped != expected {
+			t.Errorf("Escaped %q as %q, expected %q", value, escaped, expected)
+		}
+	}
+}
+
+func TestTargetFilters(t *testing.T) {
+
+	if filter := GroupFilter("cn=grads (2015),ou=groups"); filter != "(memberOf:1.2.840.113556.1.4.1941:=cn=grads \\282015\\29,ou=groups)" {
+		t.Errorf("The group filter was %q", filter)
+	}
+	if filter := UserTypeFilter([]string{"Student", "Graduate Student"}); filter != "(|(employeeType=Student)(employeeType=Graduate Student))" {
+		t.Errorf("The user type filter was %q", filter)
+	}
+
+	filterToValid := map[string]bool{
+		"(department=History)":                    true,
+		"(&(department=History)(employeeType=*))": true,
+		GroupFilter("cn=a)(b"):                    true,
+		"department=History":                      false,
+		"(department=History))(":                  false,
+		"(a=1)(b=2)":                              false,
+		"(&(department=History)":                  false,
+		"":                                        false,
+	}
+	for filter, valid := range filterToValid {
+		if err := CheckFilter(filter); (err == nil) != valid {
+			t.Errorf("Checking %q returned %v", filter, err)
+		}
+	}
+}
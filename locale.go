@@ -0,0 +1,102 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"github.com/cu-library/signtwo/i18n"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// The cookie which remembers the language a user chose.
+const LanguageCookieName = "lang"
+
+// How long a chosen language is remembered.
+const languageCookieLength = 365 * 24 * time.Hour
+
+type languageKey struct{}
+
+// withLanguage chooses the language of every request: the ?lang= query
+// parameter, which is remembered in a cookie, then the cookie, then the
+// Accept-Language header, then the default language.
+func withLanguage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		language := chooseLanguage(r)
+		if chosen := r.URL.Query().Get("lang"); chosen != "" && i18n.Supported(chosen) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     LanguageCookieName,
+				Value:    language,
+				Path:     cookiePath(),
+				HttpOnly: true,
+				Secure:   isSecureRequest(r),
+				Expires:  time.Now().Add(languageCookieLength),
+			})
+		}
+		w.Header().Set("Content-Language", language)
+		w.Header().Add("Vary", "Accept-Language, Cookie")
+
+		ctx := context.WithValue(r.Context(), languageKey{}, language)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// chooseLanguage returns the supported language the request prefers.
+func chooseLanguage(r *http.Request) string {
+	preferred := []string{r.URL.Query().Get("lang")}
+	if cookie, err := r.Cookie(LanguageCookieName); err == nil {
+		preferred = append(preferred, cookie.Value)
+	}
+	preferred = append(preferred, i18n.ParseAcceptLanguage(r.Header.Get("Accept-Language"))...)
+	return i18n.Match(preferred...)
+}
+
+// languageFor returns the language chosen for the request.
+func languageFor(r *http.Request) string {
+	if language, ok := r.Context().Value(languageKey{}).(string); ok {
+		return language
+	}
+	return chooseLanguage(r)
+}
+
+// A language the user interface can be shown in.
+type languageChoice struct {
+	Code string
+	Name string
+}
+
+// languageChoices returns the languages the user interface can be shown in.
+func languageChoices() []languageChoice {
+	choices := []languageChoice{}
+	for _, language := range i18n.Languages() {
+		choices = append(choices, languageChoice{Code: language, Name: i18n.Name(language)})
+	}
+	return choices
+}
+
+// localizedFuncs returns the template functions which depend on the
+// language: t translates a message, and lang is the language's code.
+func localizedFuncs(language string) template.FuncMap {
+	return template.FuncMap{
+		"t": func(message string, args ...interface{}) string {
+			return i18n.Translate(language, message, args...)
+		},
+		"lang": func() string {
+			return language
+		},
+	}
+}
+
+// A localizedTemplate is a page template, parsed once for each language.
+type localizedTemplate map[string]*template.Template
+
+// In returns the template in the language, or in the default language.
+func (tmpl localizedTemplate) In(language string) *template.Template {
+	if parsed, ok := tmpl[language]; ok {
+		return parsed
+	}
+	return tmpl[i18n.DefaultLanguage]
+}
@@ -7,10 +7,12 @@
 package loglevel
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
 	"sync"
+	"time"
 )
 
 type LogLevel int
@@ -31,28 +33,328 @@ var logLevelToString = map[LogLevel]string{
 	TraceMessage: "TRACE",
 }
 
+// A Component is a part of the application which can have its own log level.
+type Component string
+
+const (
+	DB   Component = "db"
+	LDAP Component = "ldap"
+	HTTP Component = "http"
+	Auth Component = "auth"
+	Mail Component = "mail"
+)
+
+// The components which can have their own log level.
+var Components = []Component{DB, LDAP, HTTP, Auth, Mail}
+
 var logMessageLevel = ErrorMessage
 var logMessageLevelMutex = new(sync.RWMutex)
 
+// The components with their own log level. The others use logMessageLevel.
+var componentLevels = map[Component]LogLevel{}
+
+// Called after any log level changes.
+var changeListeners []func()
+
 func Set(level LogLevel) {
+	logMessageLevelMutex.Lock()
+	logMessageLevel = level
+	logMessageLevelMutex.Unlock()
+
+	notifyChange()
+}
+
+// SetComponent sets the log level of one component.
+func SetComponent(component Component, level LogLevel) {
+	logMessageLevelMutex.Lock()
+	componentLevels[component] = level
+	logMessageLevelMutex.Unlock()
+
+	notifyChange()
+}
+
+// ResetComponents makes every component use the global log level again.
+func ResetComponents() {
+	logMessageLevelMutex.Lock()
+	componentLevels = map[Component]LogLevel{}
+	logMessageLevelMutex.Unlock()
+
+	notifyChange()
+}
+
+// Level returns the log level of the component.
+func Level(component Component) LogLevel {
+	logMessageLevelMutex.RLock()
+	defer logMessageLevelMutex.RUnlock()
+
+	return levelLocked(component)
+}
+
+func levelLocked(component Component) LogLevel {
+	if level, ok := componentLevels[component]; ok {
+		return level
+	}
+	return logMessageLevel
+}
+
+// Levels returns the log level of each component.
+func Levels() map[Component]LogLevel {
+	logMessageLevelMutex.RLock()
+	defer logMessageLevelMutex.RUnlock()
+
+	levels := map[Component]LogLevel{}
+	for _, component := range Components {
+		levels[component] = levelLocked(component)
+	}
+	return levels
+}
+
+// Enabled reports whether the component logs messages of the level.
+func Enabled(component Component, messagelevel LogLevel) bool {
+	return messagelevel <= Level(component)
+}
+
+// OnChange calls f after any log level changes.
+func OnChange(f func()) {
 	logMessageLevelMutex.Lock()
 	defer logMessageLevelMutex.Unlock()
 
-	logMessageLevel = level
+	changeListeners = append(changeListeners, f)
 }
 
-//Log a message if the level is below or equal to the set LogMessageLevel
-func Log(messagelevel LogLevel, message interface{}) {
+func notifyChange() {
+	logMessageLevelMutex.RLock()
+	listeners := changeListeners
+	logMessageLevelMutex.RUnlock()
+
+	for _, f := range listeners {
+		f()
+	}
+}
+
+// ParseComponent checks that the component is one of Components.
+func ParseComponent(parseThis string) (Component, error) {
+	for _, component := range Components {
+		if string(component) == strings.ToLower(parseThis) {
+			return component, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown log component '%v'.", parseThis)
+}
+
+// The formats log messages can be written in.
+type Format int
+
+const (
+	// "LEVEL: message key=value", through the standard log package.
+	TextFormat Format = iota
+	// One JSON object per line, with time, level, msg and the fields.
+	JSONFormat
+)
+
+var formatToString = map[Format]string{
+	TextFormat: "text",
+	JSONFormat: "json",
+}
+
+var logFormat = TextFormat
+var logFormatMutex = new(sync.RWMutex)
+
+func SetFormat(format Format) {
+	logFormatMutex.Lock()
+	defer logFormatMutex.Unlock()
+
+	logFormat = format
+}
+
+func (format Format) String() string {
+	return formatToString[format]
+}
+
+func ParseFormat(parseThis string) (Format, error) {
+	for format, formatString := range formatToString {
+		if formatString == strings.ToLower(parseThis) {
+			return format, nil
+		}
+	}
+	return TextFormat, fmt.Errorf("Unknown log format '%v', defaulting to text.", parseThis)
+}
+
+// ParseComponentLevels parses a comma separated list of component=LEVEL
+// pairs, like "ldap=DEBUG,db=INFO".
+func ParseComponentLevels(parseThis string) (map[Component]LogLevel, error) {
+	levels := map[Component]LogLevel{}
+	for _, pair := range strings.Split(parseThis, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected component=LEVEL, found '%v'.", pair)
+		}
+		component, err := ParseComponent(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		level, err := ParseLogLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
+
+// A Logger adds its key/value fields to every message it logs.
+// A Logger for a component uses the component's log level.
+type Logger struct {
+	component Component
+	fields    []interface{}
+}
+
+// With returns a Logger which also adds the key/value pairs to every message.
+func (logger Logger) With(keysAndValues ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(logger.fields)+len(keysAndValues))
+	fields = append(fields, logger.fields...)
+	fields = append(fields, keysAndValues...)
+	return Logger{component: logger.component, fields: fields}
+}
+
+// For returns a Logger with the same fields, for the component.
+func (logger Logger) For(component Component) Logger {
+	return Logger{component: component, fields: logger.fields}
+}
+
+// Log a message if the level is below or equal to the set LogMessageLevel
+func (logger Logger) Log(messagelevel LogLevel, message interface{}) {
+	logger.LogKV(messagelevel, message)
+}
+
+func (logger Logger) Logf(messagelevel LogLevel, format string, a ...interface{}) {
+	logger.LogKV(messagelevel, fmt.Sprintf(format, a...))
+}
+
+// LogKV logs a message with key/value fields, after the Logger's own fields.
+func (logger Logger) LogKV(messagelevel LogLevel, message interface{}, keysAndValues ...interface{}) {
 	logMessageLevelMutex.RLock()
 	defer logMessageLevelMutex.RUnlock()
 
-	if messagelevel <= logMessageLevel {
-		log.Printf("%v: %v\n", messagelevel, message)
+	if messagelevel > levelLocked(logger.component) {
+		return
+	}
+
+	fields := logger.With(keysAndValues...).fields
+	if logger.component != "" {
+		fields = append([]interface{}{"component", logger.component}, fields...)
+	}
+	logFormatMutex.RLock()
+	format := logFormat
+	logFormatMutex.RUnlock()
+
+	var line string
+	switch format {
+	case JSONFormat:
+		line = formatJSON(messagelevel, message, fields)
+	default:
+		line = fmt.Sprintf("%v: %v%v", messagelevel, message, formatTextFields(fields))
+	}
+	writeToSinks(messagelevel, format, line)
+}
+
+// A key without a value is logged with this value.
+const missingValue = "MISSING"
+
+// fieldPairs calls add for each key/value pair in fields.
+func fieldPairs(fields []interface{}, add func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		var value interface{} = missingValue
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		add(fmt.Sprint(fields[i]), value)
+	}
+}
+
+// formatTextFields formats the fields as " key=value", quoting values
+// with spaces, quotes or equals signs.
+func formatTextFields(fields []interface{}) string {
+	var b strings.Builder
+	fieldPairs(fields, func(key string, value interface{}) {
+		text := fmt.Sprint(value)
+		if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+			text = fmt.Sprintf("%q", text)
+		}
+		fmt.Fprintf(&b, " %v=%v", key, text)
+	})
+	return b.String()
+}
+
+// formatJSON formats the message as one JSON object.
+func formatJSON(messagelevel LogLevel, message interface{}, fields []interface{}) string {
+	entry := map[string]interface{}{}
+	fieldPairs(fields, func(key string, value interface{}) {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	})
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = messagelevel.String()
+	entry["msg"] = fmt.Sprint(message)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{
+			"time":  entry["time"].(string),
+			"level": ErrorMessage.String(),
+			"msg":   fmt.Sprintf("Unable to format log message %q as JSON: %v", entry["msg"], err),
+		})
 	}
+	return string(line)
+}
+
+// The default Logger has no fields.
+var defaultLogger Logger
+
+// Log a message if the level is below or equal to the set LogMessageLevel
+func Log(messagelevel LogLevel, message interface{}) {
+	defaultLogger.LogKV(messagelevel, message)
 }
 
 func Logf(messagelevel LogLevel, format string, a ...interface{}) {
-	Log(messagelevel, fmt.Sprintf(format, a), )
+	defaultLogger.LogKV(messagelevel, fmt.Sprintf(format, a...))
+}
+
+// LogKV logs a message with key/value fields.
+func LogKV(messagelevel LogLevel, message interface{}, keysAndValues ...interface{}) {
+	defaultLogger.LogKV(messagelevel, message, keysAndValues...)
+}
+
+// For returns a Logger for the component.
+func For(component Component) Logger {
+	return defaultLogger.For(component)
+}
+
+// With returns a Logger which adds the key/value pairs to every message.
+func With(keysAndValues ...interface{}) Logger {
+	return defaultLogger.With(keysAndValues...)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of the context which carries the Logger.
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the Logger carried by the context, or a Logger
+// without fields if there isn't one.
+func FromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(contextKey{}).(Logger); ok {
+		return logger
+	}
+	return defaultLogger
 }
 
 func (level LogLevel) String() string {
@@ -6,10 +6,16 @@ package loglevel
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLogLevelParse(t *testing.T) {
@@ -112,3 +118,203 @@ func TestLogLevel(t *testing.T) {
 		}
 	}
 }
+
+func TestLogFields(t *testing.T) {
+
+	Set(InfoMessage)
+	defer SetFormat(TextFormat)
+
+	b := new(bytes.Buffer)
+	log.SetOutput(b)
+	With("request_id", "abc").LogKV(InfoMessage, "Signed.", "user", "jane doe", "text", 3, "dangling")
+	expected := `INFO: Signed. request_id=abc user="jane doe" text=3 dangling=MISSING` + "\n"
+	if !strings.HasSuffix(b.String(), expected) {
+		t.Errorf("Logged %q, expected it to end with %q", b.String(), expected)
+	}
+
+	SetFormat(JSONFormat)
+	b.Reset()
+	ctx := NewContext(context.Background(), With("request_id", "abc"))
+	FromContext(ctx).LogKV(InfoMessage, "Failed.", "error", errors.New("boom"))
+	var entry map[string]interface{}
+	err := json.Unmarshal(b.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("Unable to decode %q: %v", b.String(), err)
+	}
+	for key, expected := range map[string]string{"level": "INFO", "msg": "Failed.", "request_id": "abc", "error": "boom"} {
+		if entry[key] != expected {
+			t.Errorf("Logged %v=%v, expected %v", key, entry[key], expected)
+		}
+	}
+
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("ParseFormat doesn't return error on bad input.")
+	}
+}
+
+func TestComponentLevels(t *testing.T) {
+
+	Set(WarnMessage)
+	defer ResetComponents()
+
+	levels, err := ParseComponentLevels("ldap=DEBUG, db=info")
+	if err != nil {
+		t.Fatalf("Unable to parse component levels: %v", err)
+	}
+	for component, level := range levels {
+		SetComponent(component, level)
+	}
+
+	changed := false
+	OnChange(func() { changed = true })
+
+	componentToExpectedLevel := map[Component]LogLevel{
+		LDAP: DebugMessage,
+		DB:   InfoMessage,
+		HTTP: WarnMessage,
+		Auth: WarnMessage,
+	}
+	for component, expected := range componentToExpectedLevel {
+		if level := Levels()[component]; level != expected {
+			t.Errorf("Component %v has level %v, expected %v", component, level, expected)
+		}
+	}
+
+	b := new(bytes.Buffer)
+	log.SetOutput(b)
+	For(LDAP).Log(DebugMessage, "Searching.")
+	For(HTTP).Log(DebugMessage, "Not logged.")
+	if !strings.HasSuffix(b.String(), "DEBUG: Searching. component=ldap\n") {
+		t.Errorf("Logged %q", b.String())
+	}
+
+	ResetComponents()
+	if !changed {
+		t.Error("Resetting the component levels didn't call the change listener.")
+	}
+	if Level(LDAP) != WarnMessage {
+		t.Errorf("After a reset, ldap has level %v, expected %v", Level(LDAP), WarnMessage)
+	}
+
+	for _, bad := range []string{"ldap", "nosuch=INFO", "db=LOUD"} {
+		if _, err := ParseComponentLevels(bad); err == nil {
+			t.Errorf("ParseComponentLevels(%q) doesn't return an error.", bad)
+		}
+	}
+}
+
+// A sink which remembers what it was sent.
+type memorySink struct {
+	lines []string
+}
+
+func (sink *memorySink) Write(messagelevel LogLevel, format Format, line string) error {
+	sink.lines = append(sink.lines, line)
+	return nil
+}
+
+func (sink *memorySink) Close() error {
+	return nil
+}
+
+func TestSinkLevels(t *testing.T) {
+
+	Set(TraceMessage)
+	defer CloseSinks()
+
+	errorSink, everything := new(memorySink), new(memorySink)
+	SetSinks([]LeveledSink{{Sink: errorSink, Level: ErrorMessage}, {Sink: everything, Level: TraceMessage}})
+	Log(ErrorMessage, "Broken.")
+	Log(DebugMessage, "Detail.")
+
+	if len(errorSink.lines) != 1 || errorSink.lines[0] != "ERROR: Broken." {
+		t.Errorf("The ERROR sink was sent %q", errorSink.lines)
+	}
+	if len(everything.lines) != 2 {
+		t.Errorf("The TRACE sink was sent %q", everything.lines)
+	}
+}
+
+func TestRotatingFileSink(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "signtwo.log")
+
+	sinks, err := OpenSinks("file path=" + path + " level=INFO keep=2")
+	if err != nil {
+		t.Fatalf("Unable to open sinks: %v", err)
+	}
+	sink := sinks[0].Sink.(*RotatingFileSink)
+	defer sink.Close()
+	if sinks[0].Level != InfoMessage {
+		t.Errorf("The file sink has level %v, expected %v", sinks[0].Level, InfoMessage)
+	}
+
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+	sink.MaxSize = 40
+
+	// Files which aren't rotated logs are never removed.
+	others := []string{path + ".lock", path + ".bak", path + ".2016"}
+	for _, other := range others {
+		os.WriteFile(other, nil, 0600)
+	}
+
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		err := sink.Write(InfoMessage, TextFormat, fmt.Sprintf("INFO: Message %v", i))
+		if err != nil {
+			t.Fatalf("Unable to write: %v", err)
+		}
+	}
+
+	rotated, _ := sink.rotatedFiles()
+	if len(rotated) != 2 {
+		t.Errorf("Found rotated files %v, expected 2 to be kept", rotated)
+	}
+	for _, other := range others {
+		if _, err := os.Stat(other); err != nil {
+			t.Errorf("%v was removed when rotating.", other)
+		}
+	}
+	current, _ := os.ReadFile(path)
+	if string(current) != "2016/01/01 12:00:04 INFO: Message 3\n" {
+		t.Errorf("The current file contains %q", current)
+	}
+
+	// A new period rotates the file, whatever its size.
+	sink.MaxSize = 0
+	sink.Interval = 24 * time.Hour
+	sink.period = sink.currentPeriod()
+	now = now.Add(24 * time.Hour)
+	sink.Write(InfoMessage, JSONFormat, `{"msg":"Tomorrow."}`)
+	current, _ = os.ReadFile(path)
+	if string(current) != `{"msg":"Tomorrow."}`+"\n" {
+		t.Errorf("After a new day, the current file contains %q", current)
+	}
+
+	// If the file can't be rotated, messages are still written to it.
+	sink.rename = func(oldpath, newpath string) error { return errors.New("Disk on fire.") }
+	now = now.Add(24 * time.Hour)
+	if err := sink.Write(InfoMessage, JSONFormat, `{"msg":"Still here."}`); err == nil {
+		t.Error("Write doesn't return the error from rotating.")
+	}
+	current, _ = os.ReadFile(path)
+	if string(current) != `{"msg":"Tomorrow."}`+"\n"+`{"msg":"Still here."}`+"\n" {
+		t.Errorf("After rotating failed, the current file contains %q", current)
+	}
+	sink.rename = os.Rename
+	if err := sink.Write(InfoMessage, JSONFormat, `{"msg":"Rotated."}`); err != nil {
+		t.Errorf("Unable to write after rotating works again: %v", err)
+	}
+	current, _ = os.ReadFile(path)
+	if string(current) != `{"msg":"Rotated."}`+"\n" {
+		t.Errorf("After rotating again, the current file contains %q", current)
+	}
+
+	for _, bad := range []string{"carrier-pigeon", "file level=INFO", "stderr colour=red", "file path=x maxsize=lots"} {
+		if _, err := OpenSinks(bad); err == nil {
+			t.Errorf("OpenSinks(%q) doesn't return an error.", bad)
+		}
+	}
+}
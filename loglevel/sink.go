@@ -0,0 +1,378 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package loglevel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Sink is somewhere log messages are written.
+type Sink interface {
+	// Write writes one formatted message, without a trailing newline.
+	// Messages in the JSON format include their time, text messages don't.
+	Write(messagelevel LogLevel, format Format, line string) error
+	Close() error
+}
+
+// A LeveledSink is a Sink which is only sent messages of its level
+// and below, after they pass the component's log level.
+type LeveledSink struct {
+	Sink  Sink
+	Level LogLevel
+}
+
+// Without other sinks, every message goes to stderr.
+var sinks = []LeveledSink{{Sink: StderrSink{}, Level: TraceMessage}}
+var sinksMutex = new(sync.RWMutex)
+
+// SetSinks replaces the sinks messages are written to. The previous
+// sinks are closed.
+func SetSinks(newSinks []LeveledSink) {
+	sinksMutex.Lock()
+	oldSinks := sinks
+	sinks = newSinks
+	sinksMutex.Unlock()
+
+	closeSinks(oldSinks)
+}
+
+// CloseSinks closes the sinks, and sends later messages to stderr.
+func CloseSinks() {
+	SetSinks([]LeveledSink{{Sink: StderrSink{}, Level: TraceMessage}})
+}
+
+func closeSinks(toClose []LeveledSink) {
+	for _, s := range toClose {
+		err := s.Sink.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to close log sink: %v\n", err)
+		}
+	}
+}
+
+func writeToSinks(messagelevel LogLevel, format Format, line string) {
+	sinksMutex.RLock()
+	defer sinksMutex.RUnlock()
+
+	for _, s := range sinks {
+		if messagelevel > s.Level {
+			continue
+		}
+		err := s.Sink.Write(messagelevel, format, line)
+		if err != nil {
+			// Logging the failure could fail the same way.
+			fmt.Fprintf(os.Stderr, "Unable to write log message: %v: %v\n", err, line)
+		}
+	}
+}
+
+// StderrSink writes through the standard log package, which
+// timestamps text messages and writes to stderr by default.
+type StderrSink struct{}
+
+// Serializes JSON lines written straight to the log package's writer.
+var jsonWriteMutex = new(sync.Mutex)
+
+func (StderrSink) Write(messagelevel LogLevel, format Format, line string) error {
+	if format == JSONFormat {
+		jsonWriteMutex.Lock()
+		defer jsonWriteMutex.Unlock()
+		_, err := log.Writer().Write([]byte(line + "\n"))
+		return err
+	}
+	log.Print(line)
+	return nil
+}
+
+func (StderrSink) Close() error {
+	return nil
+}
+
+// The layout of the timestamps a RotatingFileSink adds to text messages.
+const fileTimeLayout = "2006/01/02 15:04:05"
+
+// The layout of the timestamp added to the name of rotated files.
+const rotatedTimeLayout = "20060102-150405"
+
+// Matches the suffix rotate adds to the names of rotated files: the
+// timestamp, and a counter if a file was rotated earlier in the same second.
+var rotatedSuffix = regexp.MustCompile(`^\.[0-9]{8}-[0-9]{6}(-[0-9]+)?$`)
+
+// A RotatingFileSink appends to a file, which is renamed with a
+// timestamp and replaced once it reaches MaxSize bytes, or at the end
+// of each Interval. Intervals start at midnight UTC.
+type RotatingFileSink struct {
+	Path string
+	// Zero turns off rotating by size.
+	MaxSize int64
+	// Zero turns off rotating by time.
+	Interval time.Duration
+	// How many rotated files to keep. Zero keeps them all.
+	Keep int
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	period time.Time
+
+	// Replaced in tests.
+	now    func() time.Time
+	rename func(oldpath, newpath string) error
+}
+
+// NewRotatingFileSink opens the file, appending to it.
+func NewRotatingFileSink(path string, maxSize int64, interval time.Duration, keep int) (*RotatingFileSink, error) {
+	sink := &RotatingFileSink{Path: path, MaxSize: maxSize, Interval: interval, Keep: keep, now: time.Now, rename: os.Rename}
+	err := sink.open()
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *RotatingFileSink) open() error {
+	file, err := os.OpenFile(sink.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("Unable to open log file %v: %v", sink.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Unable to open log file %v: %v", sink.Path, err)
+	}
+	sink.file = file
+	sink.size = info.Size()
+	sink.period = sink.currentPeriod()
+	return nil
+}
+
+func (sink *RotatingFileSink) currentPeriod() time.Time {
+	if sink.Interval <= 0 {
+		return time.Time{}
+	}
+	return sink.now().UTC().Truncate(sink.Interval)
+}
+
+// rotate renames the file with the current time, opens a new one,
+// and removes the oldest rotated files beyond Keep. The old file is
+// only closed once the new one is open, so if rotating fails, the sink
+// keeps writing to the old file.
+func (sink *RotatingFileSink) rotate() error {
+	rotated := sink.Path + "." + sink.now().UTC().Format(rotatedTimeLayout)
+	// Don't replace a file rotated earlier in the same second.
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%v.%v-%d", sink.Path, sink.now().UTC().Format(rotatedTimeLayout), i)
+	}
+	err := sink.rename(sink.Path, rotated)
+	if err != nil {
+		return fmt.Errorf("Unable to rotate log file %v: %v", sink.Path, err)
+	}
+	old := sink.file
+	err = sink.open()
+	if err != nil {
+		return err
+	}
+	old.Close()
+	return sink.removeOldFiles()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// rotatedFiles returns the files rotate renamed the log file to. Other
+// files which share the log file's name, like app.log.bak, aren't included.
+func (sink *RotatingFileSink) rotatedFiles() ([]string, error) {
+	matches, err := filepath.Glob(sink.Path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	rotated := []string{}
+	for _, match := range matches {
+		if rotatedSuffix.MatchString(strings.TrimPrefix(match, sink.Path)) {
+			rotated = append(rotated, match)
+		}
+	}
+	return rotated, nil
+}
+
+func (sink *RotatingFileSink) removeOldFiles() error {
+	if sink.Keep <= 0 {
+		return nil
+	}
+	rotated, err := sink.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	// The timestamps sort oldest first.
+	for len(rotated) > sink.Keep {
+		err := os.Remove(rotated[0])
+		if err != nil {
+			return fmt.Errorf("Unable to remove old log file %v: %v", rotated[0], err)
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+func (sink *RotatingFileSink) Write(messagelevel LogLevel, format Format, line string) error {
+	if format != JSONFormat {
+		line = sink.now().Format(fileTimeLayout) + " " + line
+	}
+	line += "\n"
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.file == nil {
+		err := sink.open()
+		if err != nil {
+			return err
+		}
+	}
+	// If rotating fails, the line is still written to the old file.
+	var rotateErr error
+	full := sink.MaxSize > 0 && sink.size > 0 && sink.size+int64(len(line)) > sink.MaxSize
+	if full || sink.currentPeriod() != sink.period {
+		rotateErr = sink.rotate()
+	}
+
+	n, err := sink.file.WriteString(line)
+	sink.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+func (sink *RotatingFileSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
+
+// OpenSinks opens the sinks described by the spec, a semicolon separated
+// list of sinks. Each sink is its kind followed by space separated options:
+//
+//	stderr level=INFO; syslog level=ERROR tag=signtwo;
+//	file path=/var/log/signtwo.log level=TRACE maxsize=100 rotate=24h keep=7
+//
+// Every sink takes a level, TRACE if it is missing. A file's maxsize is in
+// megabytes, and rotate is a duration. An empty spec is stderr level=TRACE.
+func OpenSinks(spec string) ([]LeveledSink, error) {
+	opened := []LeveledSink{}
+	fail := func(err error) ([]LeveledSink, error) {
+		closeSinks(opened)
+		return nil, err
+	}
+
+	for _, sinkSpec := range strings.Split(spec, ";") {
+		words := strings.Fields(sinkSpec)
+		if len(words) == 0 {
+			continue
+		}
+		kind := words[0]
+		options := map[string]string{}
+		for _, word := range words[1:] {
+			parts := strings.SplitN(word, "=", 2)
+			if len(parts) != 2 {
+				return fail(fmt.Errorf("Expected option=value in the %v log sink, found '%v'.", kind, word))
+			}
+			options[parts[0]] = parts[1]
+		}
+		option := func(name string) string {
+			value := options[name]
+			delete(options, name)
+			return value
+		}
+
+		level := TraceMessage
+		if levelName := option("level"); levelName != "" {
+			var err error
+			level, err = ParseLogLevel(levelName)
+			if err != nil {
+				return fail(err)
+			}
+		}
+
+		var sink Sink
+		switch kind {
+		case "stderr":
+			sink = StderrSink{}
+		case "syslog":
+			tag := option("tag")
+			if tag == "" {
+				tag = "signtwo"
+			}
+			syslogSink, err := NewSyslogSink(tag)
+			if err != nil {
+				return fail(err)
+			}
+			sink = syslogSink
+		case "file":
+			path := option("path")
+			if path == "" {
+				return fail(errors.New("The file log sink requires a path."))
+			}
+			var maxSize int64
+			if value := option("maxsize"); value != "" {
+				megabytes, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || megabytes < 0 {
+					return fail(fmt.Errorf("Unable to parse the file log sink maxsize '%v', expected megabytes.", value))
+				}
+				maxSize = megabytes * 1024 * 1024
+			}
+			var interval time.Duration
+			if value := option("rotate"); value != "" {
+				var err error
+				interval, err = time.ParseDuration(value)
+				if err != nil || interval < 0 {
+					return fail(fmt.Errorf("Unable to parse the file log sink rotate '%v', expected a duration like 24h.", value))
+				}
+			}
+			var keep int
+			if value := option("keep"); value != "" {
+				var err error
+				keep, err = strconv.Atoi(value)
+				if err != nil || keep < 0 {
+					return fail(fmt.Errorf("Unable to parse the file log sink keep '%v'.", value))
+				}
+			}
+			fileSink, err := NewRotatingFileSink(path, maxSize, interval, keep)
+			if err != nil {
+				return fail(err)
+			}
+			sink = fileSink
+		default:
+			return fail(fmt.Errorf("Unknown log sink '%v', expected stderr, syslog or file.", kind))
+		}
+		opened = append(opened, LeveledSink{Sink: sink, Level: level})
+
+		for name := range options {
+			return fail(fmt.Errorf("Unknown option '%v' for the %v log sink.", name, kind))
+		}
+	}
+
+	if len(opened) == 0 {
+		opened = append(opened, LeveledSink{Sink: StderrSink{}, Level: TraceMessage})
+	}
+	return opened, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+
+package loglevel
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// A SyslogSink writes to the local syslog daemon, with the
+// priority matching the message's level.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the local syslog daemon, using the daemon facility.
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to syslog: %v", err)
+	}
+	return &SyslogSink{writer: writer}, nil
+}
+
+func (sink *SyslogSink) Write(messagelevel LogLevel, format Format, line string) error {
+	switch messagelevel {
+	case ErrorMessage:
+		return sink.writer.Err(line)
+	case WarnMessage:
+		return sink.writer.Warning(line)
+	case InfoMessage:
+		return sink.writer.Info(line)
+	default:
+		return sink.writer.Debug(line)
+	}
+}
+
+func (sink *SyslogSink) Close() error {
+	return sink.writer.Close()
+}
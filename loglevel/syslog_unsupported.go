@@ -0,0 +1,26 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+
+package loglevel
+
+import (
+	"errors"
+)
+
+// A SyslogSink is not available on this platform.
+type SyslogSink struct{}
+
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	return nil, errors.New("Syslog is not available on this platform.")
+}
+
+func (sink *SyslogSink) Write(messagelevel LogLevel, format Format, line string) error {
+	return errors.New("Syslog is not available on this platform.")
+}
+
+func (sink *SyslogSink) Close() error {
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/cu-library/signtwo/audit"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/gorilla/csrf"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// The component log levels set by -loglevels, restored by SIGUSR2
+// and by the reset button on the log levels page.
+var configuredComponentLevels map[l.Component]l.LogLevel
+
+// The usernames allowed to change the server's settings.
+var operatorUsernames map[string]bool
+
+// parseOperators parses a comma separated list of usernames.
+func parseOperators(list string) map[string]bool {
+	operators := map[string]bool{}
+	for _, username := range strings.Split(list, ",") {
+		username = strings.TrimSpace(username)
+		if username != "" {
+			operators[username] = true
+		}
+	}
+	return operators
+}
+
+// requireOperator returns the logged in user's username, writing an
+// error page and returning false if they aren't an operator.
+func requireOperator(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, ok := requireLogin(w, r)
+	if !ok {
+		return "", false
+	}
+	if !operatorUsernames[username] {
+		errorPage(w, r, http.StatusForbidden, "Forbidden")
+		return "", false
+	}
+	return username, true
+}
+
+// setConfiguredComponentLevels makes the component log levels match -loglevels.
+func setConfiguredComponentLevels() {
+	l.ResetComponents()
+	for component, level := range configuredComponentLevels {
+		l.SetComponent(component, level)
+	}
+}
+
+// changeLogLevelsOnSignals makes every component one level more verbose
+// on SIGUSR1, and restores the configured levels on SIGUSR2.
+func changeLogLevelsOnSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	startBackgroundJob("change log levels on SIGUSR1 and SIGUSR2", func(ctx context.Context) {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case received := <-signals:
+				if received == syscall.SIGUSR1 {
+					for component, level := range l.Levels() {
+						if level < l.TraceMessage {
+							l.SetComponent(component, level+1)
+						}
+					}
+				} else {
+					setConfiguredComponentLevels()
+				}
+				l.Logf(l.WarnMessage, "Received %v, log levels are now %v", received, formatComponentLevels(l.Levels()))
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// formatComponentLevels formats the levels like -loglevels.
+func formatComponentLevels(levels map[l.Component]l.LogLevel) string {
+	pairs := []string{}
+	for _, component := range l.Components {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", component, levels[component]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// The levels offered on the log levels page, least verbose first.
+var logLevelChoices = []l.LogLevel{l.ErrorMessage, l.WarnMessage, l.InfoMessage, l.DebugMessage, l.TraceMessage}
+
+func logLevelsGETHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Log Levels GET Handler visited.")
+
+	if _, ok := requireOperator(w, r); !ok {
+		return
+	}
+	renderTemplateOr500(w, r, logLevelsTemplate, map[string]interface{}{
+		csrf.TemplateTag: customTokenField(r),
+		"components":     l.Components,
+		"levels":         l.Levels(),
+		"choices":        logLevelChoices,
+	})
+}
+
+func logLevelsPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Log Levels POST Handler visited.")
+
+	username, ok := requireOperator(w, r)
+	if !ok {
+		return
+	}
+
+	if r.FormValue("reset") != "" {
+		setConfiguredComponentLevels()
+	} else {
+		component, err := l.ParseComponent(r.FormValue("component"))
+		if err != nil {
+			logFor(r).Logf(l.DebugMessage, "Unable to parse the component: %v", err)
+			errorPage(w, r, http.StatusBadRequest, "That isn't a known component.")
+			return
+		}
+		level, err := l.ParseLogLevel(r.FormValue("level"))
+		if err != nil {
+			logFor(r).Logf(l.DebugMessage, "Unable to parse the log level: %v", err)
+			errorPage(w, r, http.StatusBadRequest, "That isn't a known log level.")
+			return
+		}
+		l.SetComponent(component, level)
+	}
+
+	levels := formatComponentLevels(l.Levels())
+	logFor(r).For(l.Auth).LogKV(l.WarnMessage, "Log levels changed.", "username", username, "levels", levels)
+	recordAudit(r, audit.SettingChange, username, "log levels", levels)
+	setFlash(w, r, FlashSuccess, "The log levels have been changed.")
+	http.Redirect(w, r, urlFor("logLevels"), http.StatusSeeOther)
+}
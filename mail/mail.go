@@ -0,0 +1,374 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package mail sends email through an SMTP server, from a queue which
+// retries messages that fail to send.
+//
+// Any SMTP server can be used, including a local stand-in like MailHog
+// (https://github.com/mailhog/MailHog) while developing: run it, then
+// send to its SMTP port, 1025, and read the messages in its web UI.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	l "github.com/cu-library/signtwo/loglevel"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long connecting to the server and sending one message may take.
+const sendTimeout = 30 * time.Second
+
+// ErrQueueFull is returned when a message can't be queued because
+// the queue is full.
+var ErrQueueFull = errors.New("the mail queue is full")
+
+// The package's messages use the mail component's log level.
+var logger = l.For(l.Mail)
+
+// A Message is an email, with a plain text body and an optional HTML
+// alternative.
+type Message struct {
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+
+	// Extra headers, like List-Unsubscribe.
+	Headers map[string]string
+
+	// Done, if set, is called once a queued message has been sent, with
+	// nil, or once the queue gives up on it, with the last error. It
+	// isn't called for messages still queued when the queue stops.
+	Done func(err error)
+}
+
+// Bytes returns the message from the sender, formatted to be sent.
+func (msg *Message) Bytes(from string, now time.Time) ([]byte, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid sender address %q: %v", from, err)
+	}
+	to := []string{}
+	for _, recipient := range msg.To {
+		address, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recipient address %q: %v", recipient, err)
+		}
+		to = append(to, address.String())
+	}
+	if len(to) == 0 {
+		return nil, errors.New("A message needs at least one recipient.")
+	}
+
+	// Line breaks in the subject would start new headers.
+	subject := oneLine(msg.Subject)
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %v\r\n", sender)
+	fmt.Fprintf(buf, "To: %v\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %v\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%v@%v>\r\n", randomID(), domain(sender.Address))
+	names := []string{}
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(buf, "%v: %v\r\n", textproto.CanonicalMIMEHeaderKey(oneLine(name)), oneLine(msg.Headers[name]))
+	}
+	fmt.Fprint(buf, "MIME-Version: 1.0\r\n")
+
+	if msg.HTML == "" {
+		fmt.Fprint(buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprint(buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		err = writeQuotedPrintable(buf, msg.Text)
+		return buf.Bytes(), err
+	}
+
+	parts := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%v\r\n\r\n", parts.Boundary())
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = writeQuotedPrintable(w, part.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = parts.Close()
+	return buf.Bytes(), err
+}
+
+// oneLine joins the lines of a header's value.
+func oneLine(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	_, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func domain(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
+
+// A Sender sends messages.
+type Sender interface {
+	Send(msg *Message) error
+}
+
+// SMTP sends messages through an SMTP server. STARTTLS is used if the
+// server supports it. If there's a username, the connection authenticates,
+// which the standard library only allows over TLS or to localhost.
+type SMTP struct {
+	addr     string
+	username string
+	from     string
+
+	mutex    sync.RWMutex
+	password string
+}
+
+// NewSMTP creates a sender which sends through the server at addr,
+// a host:port, from the address from.
+func NewSMTP(addr, username, password, from string) (*SMTP, error) {
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SMTP server address %q: %v", addr, err)
+	}
+	_, err = mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid sender address %q: %v", from, err)
+	}
+	return &SMTP{addr: addr, username: username, password: password, from: from}, nil
+}
+
+// SetPassword changes the password used by the next messages sent.
+func (server *SMTP) SetPassword(password string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.password = password
+}
+
+// Send sends the message.
+func (server *SMTP) Send(msg *Message) error {
+	content, err := msg.Bytes(server.from, time.Now())
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(server.addr)
+
+	conn, err := net.DialTimeout("tcp", server.addr, sendTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(sendTimeout))
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+		if err != nil {
+			return err
+		}
+	}
+	if server.username != "" {
+		server.mutex.RLock()
+		auth := smtp.PlainAuth("", server.username, server.password, host)
+		server.mutex.RUnlock()
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	sender, _ := mail.ParseAddress(server.from)
+	err = client.Mail(sender.Address)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range msg.To {
+		address, _ := mail.ParseAddress(recipient)
+		err = client.Rcpt(address.Address)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// A Queue sends messages in the background. A message which fails to
+// send is tried again after a delay, which doubles after each attempt,
+// until it has been tried the queue's number of attempts.
+//
+// Queued messages are kept in memory, so messages which haven't been
+// sent when the queue stops are lost.
+type Queue struct {
+	// Observe, if set, is called with the outcome of each attempt to
+	// send a message: "sent", "retried" or "failed", or "dropped" if
+	// the message couldn't be queued.
+	Observe func(outcome string)
+
+	sender   Sender
+	attempts int
+	backoff  time.Duration
+	messages chan *queuedMessage
+}
+
+type queuedMessage struct {
+	*Message
+	attempt int
+}
+
+func (msg *queuedMessage) done(err error) {
+	if msg.Done != nil {
+		msg.Done(err)
+	}
+}
+
+// NewQueue creates a queue which holds up to size messages and sends
+// them with the sender. A message is tried up to attempts times, the
+// second time after the backoff.
+func NewQueue(sender Sender, size, attempts int, backoff time.Duration) *Queue {
+	return &Queue{
+		sender:   sender,
+		attempts: attempts,
+		backoff:  backoff,
+		messages: make(chan *queuedMessage, size),
+	}
+}
+
+func (queue *Queue) observe(outcome string) {
+	if queue.Observe != nil {
+		queue.Observe(outcome)
+	}
+}
+
+// Enqueue adds the message to the queue, or returns ErrQueueFull.
+func (queue *Queue) Enqueue(msg *Message) error {
+	return queue.add(&queuedMessage{Message: msg, attempt: 1})
+}
+
+func (queue *Queue) add(msg *queuedMessage) error {
+	select {
+	case queue.messages <- msg:
+		return nil
+	default:
+		queue.observe("dropped")
+		return ErrQueueFull
+	}
+}
+
+// Len returns the number of messages waiting to be sent.
+func (queue *Queue) Len() int {
+	return len(queue.messages)
+}
+
+// Run sends the queued messages until the context is cancelled.
+func (queue *Queue) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			if unsent := queue.Len(); unsent > 0 {
+				logger.Logf(l.WarnMessage, "Stopping with %v messages not sent.", unsent)
+			}
+			return
+		case msg := <-queue.messages:
+			queue.send(ctx, msg)
+		}
+	}
+}
+
+func (queue *Queue) send(ctx context.Context, msg *queuedMessage) {
+	err := queue.sender.Send(msg.Message)
+	if err == nil {
+		logger.Logf(l.DebugMessage, "Sent %q to %v.", msg.Subject, strings.Join(msg.To, ", "))
+		queue.observe("sent")
+		msg.done(nil)
+		return
+	}
+	if msg.attempt >= queue.attempts {
+		logger.Logf(l.ErrorMessage, "Giving up on sending %q to %v after %v attempts: %v",
+			msg.Subject, strings.Join(msg.To, ", "), msg.attempt, err)
+		queue.observe("failed")
+		msg.done(err)
+		return
+	}
+
+	delay := queue.backoff << (msg.attempt - 1)
+	logger.Logf(l.WarnMessage, "Unable to send %q to %v, trying again in %v: %v",
+		msg.Subject, strings.Join(msg.To, ", "), delay, err)
+	queue.observe("retried")
+	msg.attempt++
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+			if queue.add(msg) != nil {
+				logger.Logf(l.ErrorMessage, "Unable to requeue %q to %v: %v",
+					msg.Subject, strings.Join(msg.To, ", "), ErrQueueFull)
+				msg.done(ErrQueueFull)
+			}
+		}
+	}()
+}
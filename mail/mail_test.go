@@ -0,0 +1,220 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMessageBytes(t *testing.T) {
+
+	msg := &Message{
+		To:      []string{"Ada Lovelace <ada@example.com>"},
+		Subject: "Signed\r\nBcc: everyone@example.com",
+		Text:    "Thank you, Ada.\nYou signed Entente d'accès.",
+		HTML:    "<p>Thank you, Ada.</p>",
+		Headers: map[string]string{"list-unsubscribe-post": "List-Unsubscribe=One-Click"},
+	}
+	content, err := msg.Bytes("Library <library@example.com>", time.Date(2015, 9, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := parsed.Header.Get("Subject"); subject != "Signed Bcc: everyone@example.com" {
+		t.Errorf("The subject header was %q", subject)
+	}
+	if bcc := parsed.Header.Get("Bcc"); bcc != "" {
+		t.Errorf("The subject added a Bcc header, %q", bcc)
+	}
+	if to := parsed.Header.Get("To"); to != `"Ada Lovelace" <ada@example.com>` {
+		t.Errorf("The To header was %q", to)
+	}
+	if post := parsed.Header.Get("List-Unsubscribe-Post"); post != "List-Unsubscribe=One-Click" {
+		t.Errorf("The List-Unsubscribe-Post header was %q", post)
+	}
+	if id := parsed.Header.Get("Message-ID"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("The Message-ID header was %q", id)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("The content type was %v, %v", mediaType, err)
+	}
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, expected := range []string{"Thank you, Ada.\r\nYou signed Entente d'accès.", "<p>Thank you, Ada.</p>"} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		if string(body) != expected {
+			t.Errorf("A part was %q, expected %q", body, expected)
+		}
+	}
+
+	_, err = (&Message{To: []string{"not an address"}}).Bytes("library@example.com", time.Now())
+	if err == nil {
+		t.Error("A message to an invalid address was formatted.")
+	}
+}
+
+// fakeSMTPServer accepts one message, like a local MailHog, and
+// returns what it received.
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		transcript := new(strings.Builder)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch command := strings.ToUpper(strings.Fields(line)[0]); command {
+			case "EHLO":
+				reply("250 localhost")
+			case "DATA":
+				reply("354 Go ahead")
+				for line != ".\r\n" {
+					line, err = r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 Queued")
+			case "QUIT":
+				reply("221 Bye")
+				received <- transcript.String()
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPSend(t *testing.T) {
+
+	addr, received := fakeSMTPServer(t)
+	server, err := NewSMTP(addr, "", "", "Library <library@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Send(&Message{To: []string{"ada@example.com"}, Subject: "Signed", Text: "Thank you."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript := <-received
+	for _, expected := range []string{"MAIL FROM:<library@example.com>", "RCPT TO:<ada@example.com>",
+		"Subject: Signed\r\n", "Thank you."} {
+		if !strings.Contains(transcript, expected) {
+			t.Errorf("The server didn't receive %q in %q", expected, transcript)
+		}
+	}
+}
+
+// flakySender fails the first sends, then records the messages sent.
+type flakySender struct {
+	mutex    sync.Mutex
+	failures int
+	sent     chan *Message
+}
+
+func (sender *flakySender) Send(msg *Message) error {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	if sender.failures > 0 {
+		sender.failures--
+		return errors.New("connection refused")
+	}
+	sender.sent <- msg
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+
+	sender := &flakySender{failures: 2, sent: make(chan *Message, 1)}
+	queue := NewQueue(sender, 1, 3, time.Millisecond)
+	outcomes := make(chan string, 10)
+	queue.Observe = func(outcome string) { outcomes <- outcome }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Run(ctx)
+
+	done := make(chan error, 2)
+	msg := &Message{To: []string{"ada@example.com"}, Subject: "Signed", Done: func(err error) { done <- err }}
+	err := queue.Enqueue(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sent := <-sender.sent:
+		if sent != msg {
+			t.Errorf("Sent %v, expected %v", sent, msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The message wasn't sent.")
+	}
+	for _, expected := range []string{"retried", "retried", "sent"} {
+		if outcome := <-outcomes; outcome != expected {
+			t.Errorf("The outcome was %v, expected %v", outcome, expected)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("A sent message was done with %v", err)
+	}
+
+	sender.mutex.Lock()
+	sender.failures = 3
+	sender.mutex.Unlock()
+	err = queue.Enqueue(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"retried", "retried", "failed"} {
+		if outcome := <-outcomes; outcome != expected {
+			t.Errorf("The outcome was %v, expected %v", outcome, expected)
+		}
+	}
+	if err := <-done; err == nil {
+		t.Error("A message which failed was done without an error.")
+	}
+
+	full := NewQueue(sender, 1, 1, time.Millisecond)
+	full.Enqueue(msg)
+	if err := full.Enqueue(msg); err != ErrQueueFull {
+		t.Errorf("Queueing on a full queue returned %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Renders agreement texts written in Markdown to sanitized HTML.
+//
+// The rendered HTML is passed through an allow-list of elements and
+// attributes, so it's safe to use as template.HTML: anything which
+// could run script, like script elements, event handler attributes
+// and javascript: links, is removed.
+package markdown
+
+import (
+	"container/list"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
+	"html/template"
+	"sync"
+)
+
+// The Markdown extensions agreement texts can use.
+const extensions = blackfriday.NoIntraEmphasis | blackfriday.Tables | blackfriday.FencedCode |
+	blackfriday.Autolink | blackfriday.Strikethrough | blackfriday.SpaceHeadings |
+	blackfriday.BackslashLineBreak | blackfriday.DefinitionLists
+
+// The elements and attributes rendered Markdown may contain.
+var policy = newPolicy()
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("h1", "h2", "h3", "h4", "h5", "h6", "p", "br", "hr",
+		"ul", "ol", "li", "dl", "dt", "dd", "blockquote", "pre", "code",
+		"em", "strong", "del", "sup", "sub",
+		"table", "thead", "tbody", "tr", "th", "td")
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.RequireParseableURLs(true)
+	p.RequireNoFollowOnFullyQualifiedLinks(true)
+	return p
+}
+
+// Render returns the Markdown source as sanitized HTML.
+func Render(source string) template.HTML {
+	unsafe := blackfriday.Run([]byte(source), blackfriday.WithExtensions(extensions))
+	return template.HTML(policy.SanitizeBytes(unsafe))
+}
+
+// A Cache keeps the HTML of recently rendered sources.
+// The key must identify the source, like its hash or version.
+type Cache struct {
+	// Observe, if set, is called with the result of each lookup.
+	Observe func(hit bool)
+
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first.
+}
+
+type cacheEntry struct {
+	key  string
+	html template.HTML
+}
+
+// NewCache creates a cache which keeps up to size rendered sources.
+func NewCache(size int) *Cache {
+	return &Cache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// Render returns the cached HTML for the key, rendering the source
+// and caching the result if there isn't any.
+func (cache *Cache) Render(key, source string) template.HTML {
+	cache.mutex.Lock()
+	element, hit := cache.entries[key]
+	if hit {
+		cache.order.MoveToFront(element)
+	}
+	cache.mutex.Unlock()
+	if cache.Observe != nil {
+		cache.Observe(hit)
+	}
+	if hit {
+		return element.Value.(*cacheEntry).html
+	}
+
+	// Render without holding the lock. Two requests may render
+	// the same source at once, but the results are the same.
+	html := Render(source)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if _, ok := cache.entries[key]; !ok {
+		cache.entries[key] = cache.order.PushFront(&cacheEntry{key: key, html: html})
+		for cache.order.Len() > cache.size {
+			oldest := cache.order.Back()
+			cache.order.Remove(oldest)
+			delete(cache.entries, oldest.Value.(*cacheEntry).key)
+		}
+	}
+	return html
+}
+
+// Len returns the number of rendered sources in the cache.
+func (cache *Cache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.order.Len()
+}
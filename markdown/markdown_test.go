@@ -0,0 +1,62 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+
+	rendered := string(Render("# Terms\n\n1. Be *kind*.\n2. See [the policy](https://library.carleton.ca/policy).\n"))
+	for _, expected := range []string{"<h1>Terms</h1>", "<ol>", "<em>kind</em>",
+		`<a href="https://library.carleton.ca/policy" rel="nofollow">the policy</a>`} {
+		if !strings.Contains(rendered, expected) {
+			t.Errorf("Rendered %q, expected it to contain %q", rendered, expected)
+		}
+	}
+
+	unsafeToForbidden := map[string]string{
+		"<script>alert(1)</script>":                     "<script",
+		"[click](javascript:alert(1))":                  "javascript:",
+		`<img src="x" onerror="alert(1)">`:              "onerror",
+		`<a href="/x" onclick="alert(1)">x</a>`:         "onclick",
+		`<p style="background:url(javascript:x)">x</p>`: "style",
+		`<iframe src="https://example.com"></iframe>`:   "<iframe",
+	}
+	for source, forbidden := range unsafeToForbidden {
+		if rendered := string(Render(source)); strings.Contains(rendered, forbidden) {
+			t.Errorf("Rendering %q kept %q: %q", source, forbidden, rendered)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+
+	cache := NewCache(2)
+	hits := 0
+	cache.Observe = func(hit bool) {
+		if hit {
+			hits++
+		}
+	}
+
+	first := cache.Render("a", "**first**")
+	if cache.Render("a", "ignored, the key is cached") != first || hits != 1 {
+		t.Errorf("The second render of a key wasn't a cache hit.")
+	}
+	cache.Render("b", "second")
+	cache.Render("a", "")
+	cache.Render("c", "third")
+	if cache.Len() != 2 {
+		t.Errorf("The cache holds %v sources, expected 2", cache.Len())
+	}
+	hits = 0
+	cache.Render("b", "second")
+	if hits != 0 {
+		t.Error("The least recently used key wasn't evicted.")
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"github.com/cu-library/signtwo/db"
+	"github.com/cu-library/signtwo/ldap"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/gorilla/mux"
+	"github.com/oxtoacart/bpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The prefix of every metric name.
+const metricsNamespace = "signtwo"
+
+var (
+	httpRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "How long HTTP requests took, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	ldapDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_operation_duration_seconds",
+		Help:      "How long LDAP binds and searches took.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	ldapErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ldap_errors_total",
+		Help:      "LDAP binds and searches which failed.",
+	}, []string{"operation"})
+
+	templateFailuresCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "template_render_failures_total",
+		Help:      "Templates which failed to render, answered with 500 - Template Error.",
+	})
+
+	bufferPoolGetsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "buffer_pool_gets_total",
+		Help:      "Buffers taken from the template buffer pool, by whether a pooled buffer was reused.",
+	}, []string{"result"})
+
+	renderCacheLookupsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "markdown_cache_lookups_total",
+		Help:      "Lookups of rendered agreement texts, by whether the text was already rendered.",
+	}, []string{"result"})
+
+	signaturesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "signatures_total",
+		Help:      "Signatures, by agreement ID.",
+	}, []string{"agreement"})
+
+	downloadsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downloads_total",
+		Help:      "Downloads, by agreement ID and kind of file.",
+	}, []string{"agreement", "kind"})
+
+	emailsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "emails_total",
+		Help:      "Attempts to send email, by outcome: sent, retried, failed, or dropped when the queue was full.",
+	}, []string{"outcome"})
+	remindersCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reminders_total",
+		Help:      "Reminders queued to be sent, by agreement ID.",
+	}, []string{"agreement"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsCounter,
+		httpRequestDuration,
+		ldapDuration,
+		ldapErrorsCounter,
+		templateFailuresCounter,
+		bufferPoolGetsCounter,
+		renderCacheLookupsCounter,
+		signaturesCounter,
+		downloadsCounter,
+		emailsCounter,
+		remindersCounter,
+		newDBStatsCollector(),
+	)
+
+	ldap.Observe = func(operation string, duration time.Duration, err error) {
+		ldapDuration.WithLabelValues(operation).Observe(duration.Seconds())
+		if err != nil {
+			ldapErrorsCounter.WithLabelValues(operation).Inc()
+		}
+	}
+	renderedTexts.Observe = func(hit bool) {
+		if hit {
+			renderCacheLookupsCounter.WithLabelValues("hit").Inc()
+		} else {
+			renderCacheLookupsCounter.WithLabelValues("miss").Inc()
+		}
+	}
+}
+
+// metricsHandler serves the metrics to a scraper with the -metricstoken
+// bearer token, or to a logged in operator. The metrics name agreements
+// and reveal how busy the server is, so they aren't public.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Metrics Handler visited.")
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !validMetricsToken(header) {
+			logFor(r).For(l.Auth).Log(l.InfoMessage, "Metrics requested with an invalid bearer token.")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			errorPage(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+	} else if _, ok := requireOperator(w, r); !ok {
+		return
+	}
+	promhttp.Handler().ServeHTTP(w, r)
+}
+
+// validMetricsToken reports whether an Authorization header carries
+// the metrics bearer token. No token is valid if none is configured.
+func validMetricsToken(header string) bool {
+	token := currentMetricsToken()
+	presented := strings.TrimPrefix(header, "Bearer ")
+	return token != "" && presented != header &&
+		subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// countDownload counts a file downloaded from an agreement.
+func countDownload(agreementID int64, kind string) {
+	downloadsCounter.WithLabelValues(strconv.FormatInt(agreementID, 10), kind).Inc()
+}
+
+// The database connection pool statistics, read when metrics are collected.
+type dbStatsCollector struct {
+	openConnections   *prometheus.Desc
+	inUse             *prometheus.Desc
+	idle              *prometheus.Desc
+	maxOpen           *prometheus.Desc
+	waitCount         *prometheus.Desc
+	waitDuration      *prometheus.Desc
+	maxIdleClosed     *prometheus.Desc
+	maxLifetimeClosed *prometheus.Desc
+}
+
+func newDBStatsCollector() *dbStatsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "db", name), help, nil, nil)
+	}
+	return &dbStatsCollector{
+		openConnections:   desc("open_connections", "Established connections, in use or idle."),
+		inUse:             desc("in_use_connections", "Connections in use."),
+		idle:              desc("idle_connections", "Idle connections."),
+		maxOpen:           desc("max_open_connections", "The maximum number of open connections."),
+		waitCount:         desc("wait_count_total", "Times a query waited for a connection."),
+		waitDuration:      desc("wait_duration_seconds_total", "Time spent waiting for a connection."),
+		maxIdleClosed:     desc("max_idle_closed_total", "Connections closed because of the idle connection limit."),
+		maxLifetimeClosed: desc("max_lifetime_closed_total", "Connections closed because of the connection lifetime limit."),
+	}
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.openConnections
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.maxOpen
+	ch <- c.waitCount
+	ch <- c.waitDuration
+	ch <- c.maxIdleClosed
+	ch <- c.maxLifetimeClosed
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := db.Stats()
+	ch <- prometheus.MustNewConstMetric(c.openConnections, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.maxIdleClosed, prometheus.CounterValue, float64(stats.MaxIdleClosed))
+	ch <- prometheus.MustNewConstMetric(c.maxLifetimeClosed, prometheus.CounterValue, float64(stats.MaxLifetimeClosed))
+}
+
+// meteredBufferPool is a bpool.SizedBufferPool which counts how often
+// a pooled buffer is reused. It keeps track of how many buffers are in
+// the pool, which the SizedBufferPool doesn't expose.
+type meteredBufferPool struct {
+	mutex  sync.Mutex
+	pool   *bpool.SizedBufferPool
+	size   int
+	pooled int
+}
+
+func newMeteredBufferPool(size, alloc int) *meteredBufferPool {
+	return &meteredBufferPool{pool: bpool.NewSizedBufferPool(size, alloc), size: size}
+}
+
+func (p *meteredBufferPool) Get() *bytes.Buffer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pooled > 0 {
+		p.pooled--
+		bufferPoolGetsCounter.WithLabelValues("hit").Inc()
+	} else {
+		bufferPoolGetsCounter.WithLabelValues("miss").Inc()
+	}
+	return p.pool.Get()
+}
+
+func (p *meteredBufferPool) Put(buf *bytes.Buffer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// The pool keeps the buffer unless it is full.
+	if p.pooled < p.size {
+		p.pooled++
+	}
+	p.pool.Put(buf)
+}
+
+// statusRecorder remembers the status code and the number of bytes
+// written through a http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streamed responses through the recorder.
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// routeLabel returns the path template of the route matching the request.
+// Requests which don't match a route share one label, so stray urls
+// can't create new time series.
+func routeLabel(r *http.Request) string {
+	var match mux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil {
+		template, err := match.Route.GetPathTemplate()
+		if err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// instrumentHTTP counts and times the requests served by next.
+func instrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		route := routeLabel(r)
+		httpRequestsCounter.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The networks of the proxies whose X-Forwarded- headers are trusted.
+var trustedProxyNetworks []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR networks.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("Unable to parse trusted proxy address %q.", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%v/%v", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse trusted proxy network %q.", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy reports whether the remote address, in host:port form, is a trusted proxy.
+func isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxyNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client which made the request. If the
+// request came through trusted proxies, X-Forwarded-For is read from the
+// right, skipping the trusted proxies, so a client can't choose its own address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	var forwarded []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, address := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(address))
+		}
+	}
+
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(host); i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			break
+		}
+		host = forwarded[i]
+	}
+	return host
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package receipt creates PDF receipts of signatures, and the
+// detached Ed25519 signatures which prove they came from this server.
+package receipt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jung-kurt/gofpdf"
+	"strings"
+	"time"
+)
+
+// Details are the contents of a receipt.
+type Details struct {
+	SignatureID        int64
+	AgreementTitle     string
+	TextTitle          string
+	TextID             int64
+	Language           string
+	Content            string
+	Username           string
+	FirstName          string
+	LastName           string
+	Email              string
+	Department         string
+	UserType           string
+	BannerID           int64
+	SignedTimestampUTC time.Time
+	ContentSHA256      string
+}
+
+// ParseKey parses a hex encoded 32 byte Ed25519 seed into a private key.
+func ParseKey(hexSeed string) (ed25519.PrivateKey, error) {
+	seed, err := hex.DecodeString(hexSeed)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode receipt key: %v", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("The receipt key must be 32 bytes, 64 hex characters.")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// KeyID returns the ID of a receipt key, the start of the hex encoded
+// SHA-256 of its public key, so keys can be told apart after rotation
+// without being named.
+func KeyID(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Generate creates the PDF receipt. The same details always
+// produce the same bytes.
+func Generate(details *Details) ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+
+	// Fix everything which would otherwise vary between runs.
+	pdf.SetCreationDate(details.SignedTimestampUTC)
+	pdf.SetModificationDate(details.SignedTimestampUTC)
+	pdf.SetCatalogSort(true)
+
+	pdf.SetTitle(fmt.Sprintf("Signature receipt: %v", details.AgreementTitle), true)
+	pdf.SetAuthor("Signtwo", false)
+	pdf.SetProducer("Signtwo", false)
+
+	// The core fonts only cover Windows-1252.
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.MultiCell(0, 8, tr(details.AgreementTitle), "", "L", false)
+	if details.TextTitle != "" {
+		pdf.SetFont("Helvetica", "", 13)
+		pdf.MultiCell(0, 7, tr(details.TextTitle), "", "L", false)
+	}
+	pdf.Ln(4)
+
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.MultiCell(0, 6, "Signature receipt", "", "L", false)
+	pdf.SetFont("Helvetica", "", 10)
+	for _, line := range [][2]string{
+		{"Receipt number", fmt.Sprintf("%d", details.SignatureID)},
+		{"Signed (UTC)", details.SignedTimestampUTC.UTC().Format("2006-01-02 15:04:05 MST")},
+		{"Name", details.FirstName + " " + details.LastName},
+		{"Username", details.Username},
+		{"Email", details.Email},
+		{"Department", details.Department},
+		{"User type", details.UserType},
+		{"Banner ID", fmt.Sprintf("%d", details.BannerID)},
+		{"Agreement text", fmt.Sprintf("%d", details.TextID)},
+		{"Language", details.Language},
+		{"Content SHA-256", details.ContentSHA256},
+	} {
+		pdf.CellFormat(40, 5, line[0], "", 0, "L", false, 0, "")
+		pdf.MultiCell(0, 5, tr(line[1]), "", "L", false)
+	}
+	pdf.Ln(4)
+
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.MultiCell(0, 6, "Text signed", "", "L", false)
+	pdf.SetFont("Courier", "", 9)
+	pdf.MultiCell(0, 4, tr(details.Content), "", "L", false)
+
+	buf := new(bytes.Buffer)
+	err := pdf.Output(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate receipt PDF: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Sign returns the detached signature of the receipt.
+func Sign(key ed25519.PrivateKey, receiptPDF []byte) []byte {
+	return ed25519.Sign(key, receiptPDF)
+}
+
+// Verify reports whether the detached signature of the receipt is valid.
+func Verify(publicKey ed25519.PublicKey, receiptPDF, signature []byte) bool {
+	return len(signature) == ed25519.SignatureSize && ed25519.Verify(publicKey, receiptPDF, signature)
+}
+
+// The prefix of the line naming the key in a detached signature file.
+const keyLinePrefix = "key "
+
+// EncodeSignature returns a detached signature file: the base64 encoded
+// signature on the first line, then the ID of the key which made it.
+// The key ID is left out if it's empty.
+func EncodeSignature(keyID string, signature []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(signature) + "\n"
+	if keyID != "" {
+		encoded += keyLinePrefix + keyID + "\n"
+	}
+	return encoded
+}
+
+// DecodeSignature parses a detached signature file. The key ID is empty
+// if the file doesn't name its key, like the files made before keys had IDs.
+func DecodeSignature(file []byte) ([]byte, string, error) {
+	lines := strings.Split(strings.TrimSpace(string(file)), "\n")
+	if lines[0] == "" || len(lines) > 2 {
+		return nil, "", errors.New("A signature file has the signature, and optionally the key ID.")
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to decode the signature: %v", err)
+	}
+	if len(lines) == 1 {
+		return signature, "", nil
+	}
+	keyLine := strings.TrimSpace(lines[1])
+	if !strings.HasPrefix(keyLine, keyLinePrefix) {
+		return nil, "", errors.New("The second line of a signature file names the key.")
+	}
+	return signature, strings.TrimPrefix(keyLine, keyLinePrefix), nil
+}
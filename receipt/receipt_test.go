@@ -0,0 +1,111 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package receipt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDetails = &Details{
+	SignatureID:        42,
+	AgreementTitle:     "Thesis Deposit Agreement",
+	TextID:             3,
+	Content:            "I grant the Library a non-exclusive licence.\nÉtudiant·e·s welcome.",
+	Username:           "jsmith",
+	FirstName:          "Jane",
+	LastName:           "Smith",
+	SignedTimestampUTC: time.Date(2015, 9, 1, 14, 30, 0, 0, time.UTC),
+	ContentSHA256:      strings.Repeat("ab", 32),
+}
+
+func TestParseKey(t *testing.T) {
+	if _, err := ParseKey(strings.Repeat("0f", 32)); err != nil {
+		t.Errorf("Unable to parse a valid key: %v", err)
+	}
+	if _, err := ParseKey("0f0f"); err == nil {
+		t.Error("Parsed a key which was too short.")
+	}
+	if _, err := ParseKey(strings.Repeat("zz", 32)); err == nil {
+		t.Error("Parsed a key which wasn't hex.")
+	}
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	first, err := Generate(testDetails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Generate(testDetails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(first, []byte("%PDF-")) {
+		t.Error("Receipt isn't a PDF.")
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("The same details produced different receipts.")
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	key, _ := ParseKey(strings.Repeat("0f", 32))
+	publicKey := key.Public().(ed25519.PublicKey)
+
+	receiptPDF, err := Generate(testDetails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := Sign(key, receiptPDF)
+
+	if !Verify(publicKey, receiptPDF, signature) {
+		t.Error("Valid receipt signature didn't verify.")
+	}
+
+	tampered := append([]byte{}, receiptPDF...)
+	tampered[len(tampered)/2] ^= 0xff
+	if Verify(publicKey, tampered, signature) {
+		t.Error("Tampered receipt verified.")
+	}
+	if Verify(publicKey, receiptPDF, signature[:10]) {
+		t.Error("Truncated signature verified.")
+	}
+}
+
+func TestSignatureFiles(t *testing.T) {
+	key, _ := ParseKey(strings.Repeat("0f", 32))
+	rotated, _ := ParseKey(strings.Repeat("1e", 32))
+	keyID := KeyID(key.Public().(ed25519.PublicKey))
+	if keyID == KeyID(rotated.Public().(ed25519.PublicKey)) {
+		t.Error("Different keys have the same ID.")
+	}
+
+	signature := Sign(key, []byte("receipt"))
+	decoded, decodedID, err := DecodeSignature([]byte(EncodeSignature(keyID, signature)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, signature) || decodedID != keyID {
+		t.Errorf("Decoded signature and key %q, expected key %q.", decodedID, keyID)
+	}
+
+	// Signature files made before keys had IDs have only the signature.
+	decoded, decodedID, err = DecodeSignature([]byte(EncodeSignature("", signature)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, signature) || decodedID != "" {
+		t.Errorf("Decoded a signature without a key as key %q.", decodedID)
+	}
+
+	for _, file := range []string{"", "not base64!", "c2ln\nkeyless\n", "c2ln\nkey a\nkey b\n"} {
+		if _, _, err := DecodeSignature([]byte(file)); err == nil {
+			t.Errorf("Decoded the invalid signature file %q.", file)
+		}
+	}
+}
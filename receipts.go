@@ -0,0 +1,280 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/cu-library/signtwo/audit"
+	"github.com/cu-library/signtwo/db"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/cu-library/signtwo/receipt"
+	"github.com/gorilla/csrf"
+	"io"
+	"net/http"
+)
+
+// The largest receipt or signature file accepted for verification.
+const maxReceiptUpload = 10 << 20
+
+// The server's key for signing receipts.
+var receiptKey ed25519.PrivateKey
+
+// ensureReceipt returns the signature's stored receipt, generating,
+// signing and storing it first if there isn't one yet.
+func ensureReceipt(signature *db.Signature) (*db.Receipt, error) {
+	stored, err := db.GetReceipt(signature.ID)
+	if err != sql.ErrNoRows {
+		return stored, err
+	}
+
+	text, err := db.GetAgreementText(signature.SignedAgreementTextID)
+	if err != nil {
+		return nil, err
+	}
+	// The receipt shows the version the signer read.
+	text, err = db.TextInLanguage(text, signature.Language)
+	if err != nil {
+		return nil, err
+	}
+	// Never issue a receipt for content other than what was signed.
+	if db.ContentHash(text.Content) != signature.ContentSHA256 {
+		return nil, errors.New("The signed content has changed since it was signed.")
+	}
+	agreement, err := db.GetAgreement(text.BaseAgreementID)
+	if err != nil {
+		return nil, err
+	}
+
+	receiptPDF, err := receipt.Generate(&receipt.Details{
+		SignatureID:        signature.ID,
+		AgreementTitle:     agreement.Title,
+		TextTitle:          text.Title.String,
+		TextID:             text.ID,
+		Language:           text.Language,
+		Content:            text.Content,
+		Username:           signature.Username,
+		FirstName:          signature.FirstName,
+		LastName:           signature.LastName,
+		Email:              signature.Email,
+		Department:         signature.Department,
+		UserType:           string(signature.UserType),
+		BannerID:           signature.BannerID,
+		SignedTimestampUTC: signature.SignedTimestampUTC,
+		ContentSHA256:      signature.ContentSHA256,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The public key is recorded before it signs anything, so the
+	// receipt can still be verified after the key is rotated.
+	key := currentReceiptKey()
+	publicKey := key.Public().(ed25519.PublicKey)
+	keyID := receipt.KeyID(publicKey)
+	err = db.RegisterReceiptKey(keyID, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	generated := &db.Receipt{
+		SignatureID:      signature.ID,
+		PDF:              receiptPDF,
+		Ed25519Signature: receipt.Sign(key, receiptPDF),
+		KeyID:            keyID,
+	}
+	// If a concurrent request stored its receipt first, Store loads
+	// that one, so every request serves the same receipt.
+	err = generated.Store()
+	if err != nil {
+		return nil, err
+	}
+	return generated, nil
+}
+
+// loadReceipt loads the receipt of the signature named by the {id} route
+// variable, and the ID of the signed agreement, if the logged in user is
+// the signer or an owner of the agreement.
+// It writes an error page and returns false if it can't.
+func loadReceipt(w http.ResponseWriter, r *http.Request) (*db.Receipt, int64, bool) {
+	username, ok := requireLogin(w, r)
+	if !ok {
+		return nil, 0, false
+	}
+
+	signature, err := db.GetSignature(routeID(r))
+	if err == sql.ErrNoRows {
+		fourOhFour(w, r)
+		return nil, 0, false
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load signature: %v", err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, 0, false
+	}
+
+	text, err := db.GetAgreementText(signature.SignedAgreementTextID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load agreement text %v: %v", signature.SignedAgreementTextID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, 0, false
+	}
+	if signature.Username != username && !requireOwner(w, r, text.BaseAgreementID) {
+		return nil, 0, false
+	}
+
+	stored, err := ensureReceipt(signature)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to get the receipt of signature %v: %v", signature.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Receipt Error")
+		return nil, 0, false
+	}
+	return stored, text.BaseAgreementID, true
+}
+
+func receiptPDFHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Receipt PDF Handler visited.")
+
+	stored, agreementID, ok := loadReceipt(w, r)
+	if !ok {
+		return
+	}
+	countDownload(agreementID, "receipt")
+	username, _ := sessionUsername(r)
+	recordAudit(r, audit.FileDownload, username, fmt.Sprintf("signature %d", stored.SignatureID), "receipt.pdf")
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"receipt-%d.pdf\"", stored.SignatureID))
+	w.Write(stored.PDF)
+}
+
+func receiptSignatureHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Receipt Signature Handler visited.")
+
+	stored, agreementID, ok := loadReceipt(w, r)
+	if !ok {
+		return
+	}
+	countDownload(agreementID, "receipt signature")
+	username, _ := sessionUsername(r)
+	recordAudit(r, audit.FileDownload, username, fmt.Sprintf("signature %d", stored.SignatureID), "receipt.pdf.sig")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"receipt-%d.pdf.sig\"", stored.SignatureID))
+	fmt.Fprint(w, receipt.EncodeSignature(stored.KeyID, stored.Ed25519Signature))
+}
+
+// publicReceiptKeys returns the public keys of the current receipt
+// signing key and every key used before it, by key ID, and the IDs
+// with the current key first.
+func publicReceiptKeys() (map[string]ed25519.PublicKey, []string, error) {
+	current := currentReceiptKey().Public().(ed25519.PublicKey)
+	currentID := receipt.KeyID(current)
+	keys := map[string]ed25519.PublicKey{currentID: current}
+	ids := []string{currentID}
+
+	stored, err := db.ReceiptKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range stored {
+		if _, ok := keys[key.ID]; ok {
+			continue
+		}
+		keys[key.ID] = ed25519.PublicKey(key.PublicKey)
+		ids = append(ids, key.ID)
+	}
+	return keys, ids, nil
+}
+
+func receiptPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Receipt Public Key Handler visited.")
+
+	keys, ids, err := publicReceiptKeys()
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the receipt keys: %v", err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	// One key per line, the key ID then the base64 encoded public key,
+	// with the key new receipts are signed with first.
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, id := range ids {
+		fmt.Fprintf(w, "%v %v\n", id, base64.StdEncoding.EncodeToString(keys[id]))
+	}
+}
+
+func receiptVerifyGETHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Receipt Verify GET Handler visited.")
+	renderTemplateOr500(w, r, receiptVerifyTemplate, map[string]interface{}{
+		csrf.TemplateTag: customTokenField(r),
+	})
+}
+
+func receiptVerifyPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Receipt Verify POST Handler visited.")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxReceiptUpload*2)
+	receiptPDF, err := readUpload(r, "receipt")
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "A receipt PDF is required.")
+		return
+	}
+	encodedSignature, err := readUpload(r, "signature")
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "A receipt signature file is required.")
+		return
+	}
+	keys, _, err := publicReceiptKeys()
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the receipt keys: %v", err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	valid := false
+	signature, keyID, err := receipt.DecodeSignature(encodedSignature)
+	if err != nil {
+		logFor(r).Logf(l.DebugMessage, "Unable to decode the uploaded receipt signature: %v", err)
+	} else if keyID != "" {
+		key, ok := keys[keyID]
+		valid = ok && receipt.Verify(key, receiptPDF, signature)
+	} else {
+		// Signature files made before keys had IDs don't name their key.
+		for _, key := range keys {
+			if receipt.Verify(key, receiptPDF, signature) {
+				valid = true
+				break
+			}
+		}
+	}
+	receiptSHA256 := db.ContentHash(string(receiptPDF))
+	logFor(r).LogKV(l.InfoMessage, "Receipt verified.", "receipt_sha256", receiptSHA256, "valid", valid,
+		"client", clientIP(r))
+	// Anyone can verify a receipt. Only uploads by logged in users are
+	// audited, as each audit entry locks the audit log, and anonymous
+	// uploads could otherwise hold up every audited change.
+	if username, ok := sessionUsername(r); ok {
+		recordAudit(r, audit.FileUpload, username, "receipt verification",
+			fmt.Sprintf("receipt sha256 %v, valid %v", receiptSHA256, valid))
+	}
+
+	renderTemplateOr500(w, r, receiptVerifyTemplate, map[string]interface{}{
+		csrf.TemplateTag: customTokenField(r),
+		"checked":        true,
+		"valid":          valid,
+	})
+}
+
+// readUpload reads an uploaded file from a multipart form.
+func readUpload(r *http.Request, field string) ([]byte, error) {
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, maxReceiptUpload))
+}
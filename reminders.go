@@ -0,0 +1,615 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/cu-library/signtwo/audit"
+	"github.com/cu-library/signtwo/db"
+	"github.com/cu-library/signtwo/i18n"
+	"github.com/cu-library/signtwo/keyring"
+	"github.com/cu-library/signtwo/ldap"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often reminder campaigns are checked for reminders to send.
+const reminderCheckInterval = 15 * time.Minute
+
+// How long the unsubscribe link in a reminder works.
+const unsubscribeLinkLength = 90 * 24 * time.Hour
+
+// How long a reminder can wait in the mail queue. One queued longer
+// ago without an outcome was lost when a server stopped, and is sent again.
+const reminderLostAfter = 24 * time.Hour
+
+// The number of reminders shown in a campaign's history.
+const reminderHistoryLength = 500
+
+// The user types a campaign can target.
+var reminderUserTypes = []db.UserType{db.Student, db.GraduateStudent, db.Faculty, db.Employee}
+
+// remindersEnabled reports whether reminders can be sent. Every reminder
+// links to the agreement and to unsubscribing, so they need -siteurl.
+func remindersEnabled() bool {
+	return mailQueue != nil && *siteURL != ""
+}
+
+// startReminders sends the reminders of the reminder campaigns in the
+// background, if reminders can be sent.
+func startReminders() {
+	if mailQueue == nil {
+		return
+	}
+	if *siteURL == "" {
+		l.Log(l.WarnMessage, "No reminders will be sent, as they need -siteurl for their links.")
+		return
+	}
+	startBackgroundJob("send reminders", func(ctx context.Context) {
+		ticker := time.NewTicker(reminderCheckInterval)
+		defer ticker.Stop()
+		for {
+			runReminderCampaigns(time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// runReminderCampaigns sends the reminders which are due.
+func runReminderCampaigns(now time.Time) {
+	campaigns, err := db.DueReminderCampaigns(now)
+	if err != nil {
+		l.Logf(l.ErrorMessage, "Unable to load the reminder campaigns: %v", err)
+		return
+	}
+	for _, campaign := range campaigns {
+		// Another server may be running the campaign.
+		claimed, err := db.ClaimReminderCampaign(campaign.ID, reminderCheckInterval/2)
+		if err != nil {
+			l.Logf(l.ErrorMessage, "Unable to claim reminder campaign %v: %v", campaign.ID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		sent, err := runReminderCampaign(campaign, now)
+		if err != nil {
+			l.Logf(l.ErrorMessage, "Unable to send the reminders of campaign %v: %v", campaign.ID, err)
+		}
+		if sent > 0 {
+			l.Logf(l.InfoMessage, "Reminder campaign %v sent %v reminders.", campaign.ID, sent)
+		}
+	}
+}
+
+// runReminderCampaign sends the campaign's reminders to the people in
+// its target population who haven't signed the agreement's current
+// text, haven't opted out, and are due a reminder, up to the campaign's
+// hourly limit. It returns the number of reminders sent.
+func runReminderCampaign(campaign *db.ReminderCampaign, now time.Time) (int, error) {
+	sentLastHour, err := db.RemindersSentSince(campaign.ID, now.Add(-time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	budget := campaign.HourlyLimit - sentLastHour
+	if budget <= 0 {
+		return 0, nil
+	}
+
+	agreement, err := db.GetAgreement(campaign.AgreementID)
+	if err != nil {
+		return 0, err
+	}
+	text, err := db.CurrentAgreementText(campaign.AgreementID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	filter, err := targetFilter(campaign)
+	if err != nil {
+		return 0, err
+	}
+	people, err := ldap.Search(filter)
+	if err != nil {
+		return 0, err
+	}
+	signed, err := db.SignedUsernames(text.ID)
+	if err != nil {
+		return 0, err
+	}
+	optedOut, err := db.OptedOutOfReminders(agreement.ID)
+	if err != nil {
+		return 0, err
+	}
+	tallies, err := db.ReminderTallies(campaign.ID, text.ID, now.Add(-reminderLostAfter))
+	if err != nil {
+		return 0, err
+	}
+	usernames := make([]string, len(people))
+	for i, person := range people {
+		usernames[i] = person.Username
+	}
+	lastLanguages, err := db.LastSignatureLanguages(usernames)
+	if err != nil {
+		return 0, err
+	}
+
+	// The same people are reminded first each time, so a throttled
+	// campaign works through its population in order.
+	sort.Slice(people, func(i, j int) bool { return people[i].Username < people[j].Username })
+
+	sent := 0
+	for _, person := range people {
+		if sent == budget {
+			break
+		}
+		tally := tallies[person.Username]
+		if signed[person.Username] || optedOut[person.Username] || person.Email == "" ||
+			!reminderDue(campaign, tally, now) {
+			continue
+		}
+
+		unsubscribeURL, err := unsubscribeLink(agreement.ID, person.Username)
+		if err != nil {
+			return sent, err
+		}
+		msg, err := reminderEmailTemplate.Render(reminderLanguage(person, lastLanguages), &reminderEmail{
+			FirstName:      person.FirstName,
+			LastName:       person.LastName,
+			AgreementTitle: agreement.Title,
+			Message:        campaign.Message,
+			Reminder:       tally.Count + 1,
+			MaxReminders:   campaign.MaxReminders,
+			AgreementURL:   siteLink("agreement", "id", agreement.ID),
+			UnsubscribeURL: unsubscribeURL,
+		})
+		if err != nil {
+			return sent, err
+		}
+		// The reminder is recorded before it's queued, so its outcome
+		// can be recorded against it once the queue is done with it.
+		reminder := &db.Reminder{
+			CampaignID:      campaign.ID,
+			AgreementTextID: text.ID,
+			Username:        person.Username,
+			Email:           person.Email,
+			Sent:            now,
+		}
+		_, err = reminder.Store()
+		if err != nil {
+			return sent, fmt.Errorf("Unable to record the reminder to %v: %v", person.Username, err)
+		}
+
+		msg.To = []string{person.Email}
+		msg.Headers = map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+		msg.Done = func(err error) {
+			recordReminderOutcome(reminder.ID, err)
+		}
+		err = mailQueue.Enqueue(msg)
+		if err != nil {
+			recordReminderOutcome(reminder.ID, err)
+			// The rest are sent on a later run.
+			return sent, err
+		}
+		remindersCounter.WithLabelValues(strconv.FormatInt(agreement.ID, 10)).Inc()
+		sent++
+	}
+	return sent, nil
+}
+
+// reminderLanguage returns the language to remind the person in: the
+// language they prefer in the directory, or else the language they
+// last signed an agreement in, or else the default language.
+func reminderLanguage(person *ldap.Person, lastLanguages map[string]string) string {
+	return i18n.Match(person.PreferredLanguage, lastLanguages[person.Username])
+}
+
+// recordReminderOutcome records whether the reminder was sent, from
+// the error the mail queue was done with.
+func recordReminderOutcome(reminderID int64, sendErr error) {
+	outcome := db.ReminderSent
+	if sendErr != nil {
+		outcome = db.ReminderFailed
+	}
+	err := db.RecordReminderOutcome(reminderID, outcome)
+	if err != nil {
+		l.Logf(l.ErrorMessage, "Unable to record that reminder %v was %v: %v", reminderID, outcome, err)
+	}
+}
+
+// reminderDue reports whether someone with the tally of reminders from
+// the campaign should be reminded again.
+func reminderDue(campaign *db.ReminderCampaign, tally db.ReminderTally, now time.Time) bool {
+	if tally.Count >= campaign.MaxReminders {
+		return false
+	}
+	return tally.Count == 0 || now.Sub(tally.Last) >= time.Duration(campaign.IntervalDays)*24*time.Hour
+}
+
+// targetFilter returns the directory search filter matching the
+// campaign's target population.
+func targetFilter(campaign *db.ReminderCampaign) (string, error) {
+	switch campaign.TargetKind {
+	case db.TargetGroup:
+		return ldap.GroupFilter(campaign.Target), nil
+	case db.TargetFilter:
+		return campaign.Target, ldap.CheckFilter(campaign.Target)
+	case db.TargetUserTypes:
+		return ldap.UserTypeFilter(strings.Split(campaign.Target, ",")), nil
+	}
+	return "", fmt.Errorf("Unknown target kind %q", campaign.TargetKind)
+}
+
+// The details shown in a reminder.
+type reminderEmail struct {
+	FirstName      string
+	LastName       string
+	AgreementTitle string
+	Message        string
+	Reminder       int
+	MaxReminders   int
+	AgreementURL   string
+	UnsubscribeURL string
+}
+
+// An unsubscription is who an unsubscribe link is for, and from what.
+type unsubscription struct {
+	AgreementID int64
+	Username    string
+}
+
+// unsubscribeCodecs returns the codecs which sign unsubscribe links.
+func unsubscribeCodecs() []securecookie.Codec {
+	return signingCodecs((*keyring.Key).UnsubscribeKey, unsubscribeLinkLength)
+}
+
+// unsubscribeLink returns the absolute url which stops the user's
+// reminders about the agreement. The link is signed, so it can't be
+// changed to unsubscribe someone else, and it works without logging in.
+func unsubscribeLink(agreementID int64, username string) (string, error) {
+	token, err := securecookie.EncodeMulti("unsubscribe", &unsubscription{agreementID, username}, unsubscribeCodecs()...)
+	if err != nil {
+		return "", err
+	}
+	return siteLink("unsubscribe") + "?" + url.Values{"token": {token}}.Encode(), nil
+}
+
+// unsubscribeData checks the request's unsubscribe token and loads the
+// agreement it's for, writing an error page and returning false if the
+// token isn't valid.
+func unsubscribeData(w http.ResponseWriter, r *http.Request) (map[string]interface{}, *unsubscription, bool) {
+	token := r.FormValue("token")
+	unsubscribe := new(unsubscription)
+	err := securecookie.DecodeMulti("unsubscribe", token, unsubscribe, unsubscribeCodecs()...)
+	if err != nil {
+		logFor(r).Logf(l.InfoMessage, "Invalid unsubscribe link: %v", err)
+		errorPage(w, r, http.StatusBadRequest, "This link has expired or isn't valid. Use the link in your most recent reminder.")
+		return nil, nil, false
+	}
+	agreement, err := db.GetAgreement(unsubscribe.AgreementID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load agreement %v: %v", unsubscribe.AgreementID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, nil, false
+	}
+	return map[string]interface{}{
+		"agreement": agreement,
+		"token":     token,
+	}, unsubscribe, true
+}
+
+// unsubscribeGETHandler asks the user to confirm they want to stop
+// reminders. Following the link doesn't unsubscribe, so mail scanners
+// which follow every link don't unsubscribe anyone.
+func unsubscribeGETHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Unsubscribe GET Handler visited.")
+
+	data, _, ok := unsubscribeData(w, r)
+	if !ok {
+		return
+	}
+	renderTemplateOr500(w, r, unsubscribeTemplate, data)
+}
+
+// unsubscribePOSTHandler stops the user's reminders about the agreement.
+// It's also the one-click unsubscribe of RFC 8058, which mail clients
+// post to the List-Unsubscribe url. The signed token takes the place of
+// the CSRF token, which those posts can't include.
+func unsubscribePOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Unsubscribe POST Handler visited.")
+
+	data, unsubscribe, ok := unsubscribeData(w, r)
+	if !ok {
+		return
+	}
+	err := db.OptOutOfReminders(unsubscribe.AgreementID, unsubscribe.Username)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to opt %v out of reminders about agreement %v: %v",
+			unsubscribe.Username, unsubscribe.AgreementID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	logFor(r).LogKV(l.InfoMessage, "Opted out of reminders.", "username", unsubscribe.Username,
+		"agreement", unsubscribe.AgreementID)
+	recordAudit(r, audit.ReminderOptOut, unsubscribe.Username, fmt.Sprintf("agreement %d", unsubscribe.AgreementID), "")
+
+	data["unsubscribed"] = true
+	renderTemplateOr500(w, r, unsubscribeTemplate, data)
+}
+
+func remindersHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Reminders Handler visited.")
+
+	agreement, ok := loadOwnedAgreement(w, r)
+	if !ok {
+		return
+	}
+	campaigns, err := db.ReminderCampaigns(agreement.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the reminder campaigns of agreement %v: %v", agreement.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	renderTemplateOr500(w, r, remindersTemplate, map[string]interface{}{
+		"agreement": agreement,
+		"campaigns": campaigns,
+		"enabled":   remindersEnabled(),
+	})
+}
+
+// reminderCampaignData returns the template data of the campaign's page.
+func reminderCampaignData(r *http.Request, agreement *db.Agreement, campaign *db.ReminderCampaign) map[string]interface{} {
+	selectedTypes := map[db.UserType]bool{}
+	if campaign.TargetKind == db.TargetUserTypes {
+		for _, userType := range strings.Split(campaign.Target, ",") {
+			selectedTypes[db.UserType(userType)] = true
+		}
+	}
+	data := map[string]interface{}{
+		csrf.TemplateTag: customTokenField(r),
+		"agreement":      agreement,
+		"campaign":       campaign,
+		"userTypes":      reminderUserTypes,
+		"selectedTypes":  selectedTypes,
+		"enabled":        remindersEnabled(),
+	}
+	switch campaign.TargetKind {
+	case db.TargetGroup:
+		data["group"] = campaign.Target
+	case db.TargetFilter:
+		data["filter"] = campaign.Target
+	}
+	return data
+}
+
+func reminderNewGETHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Reminder New GET Handler visited.")
+
+	agreement, ok := loadOwnedAgreement(w, r)
+	if !ok {
+		return
+	}
+	campaign := &db.ReminderCampaign{
+		AgreementID:  agreement.ID,
+		TargetKind:   db.TargetUserTypes,
+		StartDate:    time.Now(),
+		IntervalDays: 7,
+		MaxReminders: 3,
+		HourlyLimit:  100,
+		Enabled:      true,
+	}
+	renderTemplateOr500(w, r, reminderTemplate, reminderCampaignData(r, agreement, campaign))
+}
+
+func reminderNewPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Reminder New POST Handler visited.")
+
+	agreement, ok := loadOwnedAgreement(w, r)
+	if !ok {
+		return
+	}
+	username, _ := sessionUsername(r)
+	campaign := &db.ReminderCampaign{AgreementID: agreement.ID, Created: time.Now(), CreatedBy: username}
+	err := campaignFromForm(r, campaign)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = campaign.Store()
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to store a reminder campaign of agreement %v: %v", agreement.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	recordAudit(r, audit.ReminderChange, username, fmt.Sprintf("reminder campaign %d", campaign.ID),
+		fmt.Sprintf("agreement %d, version %d, %v", agreement.ID, campaign.Version, campaignSummary(campaign)))
+
+	setFlash(w, r, FlashSuccess, "Your changes have been saved.")
+	http.Redirect(w, r, urlFor("reminderCampaign", "id", campaign.ID), http.StatusSeeOther)
+}
+
+// loadReminderCampaign loads the campaign named by the {id} route
+// variable and its agreement, if the user owns it, writing an error
+// page and returning false if it can't.
+func loadReminderCampaign(w http.ResponseWriter, r *http.Request) (*db.ReminderCampaign, *db.Agreement, bool) {
+	if _, ok := requireLogin(w, r); !ok {
+		return nil, nil, false
+	}
+	campaign, err := db.GetReminderCampaign(routeID(r))
+	if err == sql.ErrNoRows {
+		fourOhFour(w, r)
+		return nil, nil, false
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load reminder campaign: %v", err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, nil, false
+	}
+	if !requireOwner(w, r, campaign.AgreementID) {
+		return nil, nil, false
+	}
+	agreement, err := db.GetAgreement(campaign.AgreementID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load agreement %v: %v", campaign.AgreementID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, nil, false
+	}
+	return campaign, agreement, true
+}
+
+func reminderCampaignGETHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Reminder Campaign GET Handler visited.")
+
+	campaign, agreement, ok := loadReminderCampaign(w, r)
+	if !ok {
+		return
+	}
+	reminders, err := db.Reminders(campaign.ID, reminderHistoryLength)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the reminders of campaign %v: %v", campaign.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	data := reminderCampaignData(r, agreement, campaign)
+	data["reminders"] = reminders
+	renderTemplateOr500(w, r, reminderTemplate, data)
+}
+
+func reminderCampaignPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Reminder Campaign POST Handler visited.")
+
+	stored, agreement, ok := loadReminderCampaign(w, r)
+	if !ok {
+		return
+	}
+	version, err := strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	edited := *stored
+	edited.Version = version
+	err = campaignFromForm(r, &edited)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = edited.Store()
+	if err == db.ErrConflict {
+		logFor(r).Logf(l.InfoMessage, "Edit conflict on reminder campaign %v.", stored.ID)
+		current, err := db.GetReminderCampaign(stored.ID)
+		if err != nil {
+			logFor(r).Logf(l.ErrorMessage, "Unable to reload reminder campaign %v: %v", stored.ID, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database Error")
+			return
+		}
+
+		// Keep the user's edit in the form, against the current version.
+		edited.Version = current.Version
+		data := reminderCampaignData(r, agreement, &edited)
+		data["current"] = current
+		renderTemplateOr500CustomStatus(w, r, reminderTemplate, data, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to store reminder campaign %v: %v", stored.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	username, _ := sessionUsername(r)
+	recordAudit(r, audit.ReminderChange, username, fmt.Sprintf("reminder campaign %d", edited.ID),
+		fmt.Sprintf("agreement %d, version %d, %v", agreement.ID, edited.Version, campaignSummary(&edited)))
+
+	setFlash(w, r, FlashSuccess, "Your changes have been saved.")
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
+
+// campaignFromForm sets the campaign's settings from the submitted form.
+// The error's message can be shown to the user.
+func campaignFromForm(r *http.Request, campaign *db.ReminderCampaign) error {
+	campaign.TargetKind = db.TargetKind(r.FormValue("targetkind"))
+	switch campaign.TargetKind {
+	case db.TargetGroup:
+		campaign.Target = strings.TrimSpace(r.FormValue("group"))
+		if campaign.Target == "" {
+			return errors.New("Enter the DN of the group to remind.")
+		}
+	case db.TargetFilter:
+		campaign.Target = strings.TrimSpace(r.FormValue("filter"))
+		if ldap.CheckFilter(campaign.Target) != nil {
+			return errors.New("The filter must be in parentheses, and its parentheses must balance.")
+		}
+	case db.TargetUserTypes:
+		chosen := []string{}
+		for _, userType := range reminderUserTypes {
+			for _, value := range r.Form["usertype"] {
+				if value == string(userType) {
+					chosen = append(chosen, value)
+				}
+			}
+		}
+		if len(chosen) == 0 {
+			return errors.New("Choose at least one user type to remind.")
+		}
+		campaign.Target = strings.Join(chosen, ",")
+	default:
+		return errors.New("Choose who to remind: a group, a filter, or user types.")
+	}
+
+	startDate, err := time.Parse(formDateLayout, r.FormValue("startdate"))
+	if err != nil {
+		return errors.New("Enter the date to start sending reminders, like 2015-09-01.")
+	}
+	campaign.StartDate = startDate
+	campaign.Message = strings.TrimSpace(r.FormValue("message"))
+	campaign.Enabled = r.FormValue("enabled") == "on"
+
+	numbers := []struct {
+		field string
+		value *int
+	}{
+		{"intervaldays", &campaign.IntervalDays},
+		{"maxreminders", &campaign.MaxReminders},
+		{"hourlylimit", &campaign.HourlyLimit},
+	}
+	for _, number := range numbers {
+		value, err := strconv.Atoi(r.FormValue(number.field))
+		if err != nil || value < 1 {
+			return errors.New("The days between reminders, the number of reminders and the hourly limit must be whole numbers above zero.")
+		}
+		*number.value = value
+	}
+	return nil
+}
+
+// campaignSummary describes the campaign's settings for the audit log.
+func campaignSummary(campaign *db.ReminderCampaign) string {
+	return fmt.Sprintf("%v %q, from %v, every %d days, up to %d reminders, %d an hour, enabled %v",
+		campaign.TargetKind, campaign.Target, campaign.StartDate.Format(formDateLayout),
+		campaign.IntervalDays, campaign.MaxReminders, campaign.HourlyLimit, campaign.Enabled)
+}
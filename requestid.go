@@ -0,0 +1,73 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	l "github.com/cu-library/signtwo/loglevel"
+	"net/http"
+)
+
+// The header carrying the request ID, in requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+// The longest incoming request ID which is kept.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// newRequestID returns a random 128 bit ID, hex encoded.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		l.Logf(l.ErrorMessage, "Unable to generate a request ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an incoming request ID is safe to log
+// and echo: not too long, and only printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID gives every request an ID, keeping a valid incoming
+// X-Request-ID. The ID is returned in the response header, and the
+// request's Logger, for the http component, adds it to every message.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = l.NewContext(ctx, l.For(l.HTTP).With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestID returns the request's ID, or the empty string outside withRequestID.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// logFor returns the Logger of the request.
+func logFor(r *http.Request) l.Logger {
+	return l.FromContext(r.Context())
+}
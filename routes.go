@@ -0,0 +1,157 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/gorilla/mux"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// The application's router. URLs are built from its named routes,
+// so they include the base path.
+var router = mux.NewRouter()
+
+// The functions available in templates.
+var templateFuncs = template.FuncMap{
+	"url":              templateURL,
+	"static":           staticURL,
+	"themeStatic":      themeStaticURL,
+	"themeStylesheets": themeStylesheetURLs,
+	"languages":        languageChoices,
+	"textHTML":         textHTML,
+}
+
+// normalizeBasePath returns the base path with a leading slash and
+// without a trailing slash, so "signtwo/" becomes "/signtwo".
+// Serving from the root is the empty string.
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// newRouter creates the router, with every route mounted under the base path.
+func newRouter(basePath string) *mux.Router {
+	root := mux.NewRouter()
+	root.NotFoundHandler = http.HandlerFunc(fourOhFour)
+	root.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+
+	r := root
+	if basePath != "" {
+		root.Path(basePath).Handler(http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+		r = root.PathPrefix(basePath).Subrouter()
+		r.MethodNotAllowedHandler = root.MethodNotAllowedHandler
+	}
+
+	r.Path("/").Methods("GET").HandlerFunc(homeHandler).Name("home")
+	r.Path("/healthz").Methods("GET").HandlerFunc(healthzHandler).Name("healthz")
+	r.Path("/readyz").Methods("GET").HandlerFunc(readyzHandler).Name("readyz")
+	r.Path("/metrics").Methods("GET").HandlerFunc(metricsHandler).Name("metrics")
+	r.Path("/login").Methods("GET").HandlerFunc(loginGETHandler).Name("login")
+	r.Path("/login").Methods("POST").HandlerFunc(loginPOSTHandler)
+	r.Path("/agreements/{id:[0-9]+}").Methods("GET").HandlerFunc(agreementHandler).Name("agreement")
+	r.Path("/agreements/{id:[0-9]+}/changes").Methods("GET").HandlerFunc(changesHandler).Name("changes")
+	r.Path("/agreements/{id:[0-9]+}/sign").Methods("POST").HandlerFunc(signPOSTHandler).Name("sign")
+	r.Path("/signatures/{id:[0-9]+}/receipt.pdf").Methods("GET").HandlerFunc(receiptPDFHandler).Name("receipt")
+	r.Path("/signatures/{id:[0-9]+}/receipt.pdf.sig").Methods("GET").HandlerFunc(receiptSignatureHandler).Name("receiptSignature")
+	r.Path("/receipts/publickey").Methods("GET").HandlerFunc(receiptPublicKeyHandler).Name("receiptPublicKey")
+	r.Path("/receipts/verify").Methods("GET").HandlerFunc(receiptVerifyGETHandler).Name("receiptVerify")
+	r.Path("/receipts/verify").Methods("POST").HandlerFunc(receiptVerifyPOSTHandler)
+	r.Path("/unsubscribe").Methods("GET").HandlerFunc(unsubscribeGETHandler).Name("unsubscribe")
+	r.Path("/unsubscribe").Methods("POST").HandlerFunc(unsubscribePOSTHandler)
+	r.Path("/admin").Methods("GET").HandlerFunc(adminHandler).Name("admin")
+	r.Path("/admin/preview").Methods("POST").HandlerFunc(previewPOSTHandler).Name("preview")
+	r.Path("/admin/loglevels").Methods("GET").HandlerFunc(logLevelsGETHandler).Name("logLevels")
+	r.Path("/admin/loglevels").Methods("POST").HandlerFunc(logLevelsPOSTHandler)
+	r.Path("/admin/agreements/{id:[0-9]+}").Methods("GET").HandlerFunc(agreementEditGETHandler).Name("agreementEdit")
+	r.Path("/admin/agreements/{id:[0-9]+}").Methods("POST").HandlerFunc(agreementEditPOSTHandler)
+	r.Path("/admin/agreements/{id:[0-9]+}/notifications").Methods("POST").HandlerFunc(ownerNotificationsPOSTHandler).Name("ownerNotifications")
+	r.Path("/admin/agreements/{id:[0-9]+}/reminders").Methods("GET").HandlerFunc(remindersHandler).Name("reminders")
+	r.Path("/admin/agreements/{id:[0-9]+}/reminders/new").Methods("GET").HandlerFunc(reminderNewGETHandler).Name("reminderNew")
+	r.Path("/admin/agreements/{id:[0-9]+}/reminders/new").Methods("POST").HandlerFunc(reminderNewPOSTHandler)
+	r.Path("/admin/reminders/{id:[0-9]+}").Methods("GET").HandlerFunc(reminderCampaignGETHandler).Name("reminderCampaign")
+	r.Path("/admin/reminders/{id:[0-9]+}").Methods("POST").HandlerFunc(reminderCampaignPOSTHandler)
+	r.Path("/admin/agreements/{id:[0-9]+}/signatures").Methods("GET").HandlerFunc(signaturesHandler).Name("signatures")
+	r.Path("/admin/texts/{id:[0-9]+}").Methods("GET").HandlerFunc(textEditGETHandler).Name("textEdit")
+	r.Path("/admin/texts/{id:[0-9]+}").Methods("POST").HandlerFunc(textEditPOSTHandler)
+	r.Path("/admin/texts/{id:[0-9]+}/translations").Methods("POST").HandlerFunc(textTranslationPOSTHandler).Name("textTranslation")
+	r.Path("/admin/texts/{id:[0-9]+}/corrections").Methods("POST").HandlerFunc(textCorrectionPOSTHandler).Name("textCorrection")
+	r.Path("/admin/signatures/{id:[0-9]+}").Methods("GET").HandlerFunc(signatureGETHandler).Name("signature")
+	r.Path("/admin/signatures/{id:[0-9]+}/corrections").Methods("POST").HandlerFunc(signatureCorrectionPOSTHandler).Name("signatureCorrection")
+	r.PathPrefix("/static/").Methods("GET").Name("static").
+		Handler(http.StripPrefix(basePath+"/static", http.HandlerFunc(serveStatic)))
+	r.PathPrefix("/theme/").Methods("GET").Name("themeStatic").
+		Handler(http.StripPrefix(basePath+"/theme", http.HandlerFunc(serveThemeStatic)))
+
+	return root
+}
+
+// urlFor builds the path of a named route, from pairs of route variable names and values.
+func urlFor(name string, pairs ...interface{}) string {
+	route := router.Get(name)
+	if route == nil {
+		l.Logf(l.ErrorMessage, "No route named %v.", name)
+		return ""
+	}
+
+	stringPairs := make([]string, len(pairs))
+	for i, value := range pairs {
+		stringPairs[i] = fmt.Sprint(value)
+	}
+	u, err := route.URL(stringPairs...)
+	if err != nil {
+		l.Logf(l.ErrorMessage, "Unable to build the url of route %v: %v", name, err)
+		return ""
+	}
+	return u.Path
+}
+
+// templateURL is urlFor, returning an error to stop rendering instead of an empty url.
+func templateURL(name string, pairs ...interface{}) (string, error) {
+	path := urlFor(name, pairs...)
+	if path == "" {
+		return "", fmt.Errorf("Unable to build the url of route %v", name)
+	}
+	return path, nil
+}
+
+// staticURL returns the path of a static file, with its content hash in the name.
+// Like the other template functions here, it is called while rendering, with
+// assetsMutex held.
+func staticURL(file string) string {
+	return urlFor("static") + staticAssets.name(file)
+}
+
+// themeStaticURL returns the path of a file in the theme's static directory.
+func themeStaticURL(file string) string {
+	if themeAssets == nil {
+		return urlFor("themeStatic") + file
+	}
+	return urlFor("themeStatic") + themeAssets.name(file)
+}
+
+// themeStylesheetURLs returns the paths of the theme's stylesheets,
+// which are linked after the built in ones.
+func themeStylesheetURLs() []string {
+	urls := []string{}
+	if themeAssets == nil {
+		return urls
+	}
+	for _, name := range themeAssets.stylesheets() {
+		urls = append(urls, themeStaticURL(name))
+	}
+	return urls
+}
+
+// cookiePath returns the path cookies are scoped to.
+func cookiePath() string {
+	return urlFor("home")
+}
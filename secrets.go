@@ -0,0 +1,342 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"github.com/cu-library/signtwo/db"
+	"github.com/cu-library/signtwo/keyring"
+	"github.com/cu-library/signtwo/ldap"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/cu-library/signtwo/receipt"
+	"github.com/gorilla/csrf"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The flags which can instead be read from a file named by an environment
+// variable with a _FILE suffix, like SIGNTWO_SECRET_FILE. This keeps them
+// out of ps and container inspect output.
+var secretFileFlags = []string{"dburl", "ldappass", "secret", "receiptkey", "smtppass", "metricstoken"}
+
+// The secret files which were read, by flag name, so they can be reloaded.
+var secretFiles = map[string]string{}
+
+// Guards the keys derived from the secrets, which are replaced on reload.
+var secretsMutex = new(sync.RWMutex)
+
+// The bearer token which lets a scraper read the metrics, if any.
+var metricsToken string
+
+// The keyring the secret flag was parsed into.
+var currentKeyring *keyring.Keyring
+
+// A csrfVariant names one way of protecting the router: the key, and
+// whether the CSRF cookie is only sent over HTTPS.
+type csrfVariant struct {
+	keyID  string
+	secure bool
+}
+
+// The router protected by each key's CSRF cookie.
+var csrfProtected map[csrfVariant]http.Handler
+
+// secretFileEnvironmentVariable returns the name of the environment
+// variable which names the flag's secret file.
+func secretFileEnvironmentVariable(flagName string) string {
+	return fmt.Sprintf("%v%v_FILE", EnvPrefix, strings.ToUpper(flagName))
+}
+
+// readSecretFile reads a secret from a file, without its trailing newline.
+// World-readable files are refused.
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0004 != 0 {
+		return "", fmt.Errorf("Refusing to read the secret file %v, as it is world-readable. "+
+			"Remove the permission using 'chmod o-r %v'.", path, path)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// loadSecretFiles sets the secret flags which weren't set on the command
+// line from the files named by their _FILE environment variables.
+func loadSecretFiles() error {
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setOnCommandLine[f.Name] = true })
+
+	for _, name := range secretFileFlags {
+		environmentVariableName := secretFileEnvironmentVariable(name)
+		path := os.Getenv(environmentVariableName)
+		if path == "" || setOnCommandLine[name] {
+			continue
+		}
+		if os.Getenv(EnvPrefix+strings.ToUpper(name)) != "" {
+			return fmt.Errorf("Both %v%v and %v are set, only one can be used.",
+				EnvPrefix, strings.ToUpper(name), environmentVariableName)
+		}
+
+		value, err := readSecretFile(path)
+		if err != nil {
+			return fmt.Errorf("Unable to read %v from %v: %v", name, environmentVariableName, err)
+		}
+		err = flag.Lookup(name).Value.Set(value)
+		if err != nil {
+			return fmt.Errorf("Unable to set configuration option %v from %v: %v", name, path, err)
+		}
+		secretFiles[name] = path
+		flagSources[name] = "secret file " + path
+	}
+	return nil
+}
+
+// applySecrets parses the keyring and receipt key from the secret flags,
+// protects the router with the CSRF part of each key, and sets the
+// metrics token.
+func applySecrets(router http.Handler) error {
+	parsedKeyring, err := keyring.Parse(*secretHex)
+	if err != nil {
+		return fmt.Errorf("Unable to parse secret: %v Generate a key using 'signtwo gen-secret'", err)
+	}
+	if parsedKeyring.Newest().Retired(time.Now()) {
+		return fmt.Errorf("The newest key, %v, has retired. Generate a key using 'signtwo gen-secret'",
+			parsedKeyring.Newest().ID)
+	}
+	parsedReceiptKey, err := receipt.ParseKey(*receiptKeyHex)
+	if err != nil {
+		return fmt.Errorf("%v Generate using 'openssl rand -hex 32'", err)
+	}
+
+	// Each key has its own cookie, so forms rendered with an older key
+	// keep working after a newer key is added. If a request doesn't pass
+	// with one key, it is tried with the next older key.
+	protected := make(map[csrfVariant]http.Handler)
+	for i, key := range parsedKeyring.Keys {
+		olderKeys := parsedKeyring.Keys[i+1:]
+		for _, secure := range []bool{true, false} {
+			secure := secure
+			CSRF := csrf.Protect(key.CSRFKey(),
+				csrf.Secure(secure),
+				csrf.FieldName("csrf-token"),
+				csrf.CookieName("csrf-token-"+key.ID),
+				csrf.Path(cookiePath()),
+				csrf.ErrorHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					serveWithOlderCSRFKey(w, r, olderKeys, secure)
+				})))
+			protected[csrfVariant{key.ID, secure}] = CSRF(router)
+		}
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	currentKeyring = parsedKeyring
+	receiptKey = parsedReceiptKey
+	csrfProtected = protected
+	metricsToken = *metricsTokenFlag
+	return nil
+}
+
+// serveWithOlderCSRFKey tries the request with the first of the older
+// keys which hasn't retired, failing the request if there are none.
+func serveWithOlderCSRFKey(w http.ResponseWriter, r *http.Request, olderKeys []*keyring.Key, secure bool) {
+	now := time.Now()
+	for _, key := range olderKeys {
+		if key.Retired(now) {
+			continue
+		}
+		secretsMutex.RLock()
+		handler, ok := csrfProtected[csrfVariant{key.ID, secure}]
+		secretsMutex.RUnlock()
+		if ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	csrfFailure(w, r)
+}
+
+// A csrfRetry submits a form which failed the CSRF check again, with a new token.
+type csrfRetry struct {
+	Action     string
+	Fields     []csrfRetryField
+	Incomplete bool
+}
+
+type csrfRetryField struct {
+	Name  string
+	Value string
+}
+
+// csrfFailure explains that a form expired, and offers to submit it again.
+// The retry is only offered for forms submitted from this site, so another
+// site can't prepare a form for the user to confirm. Passwords aren't kept,
+// and forms with uploaded files can't be retried.
+func csrfFailure(w http.ResponseWriter, r *http.Request) {
+	logFor(r).For(l.Auth).Logf(l.InfoMessage, "CSRF check failed: %v", csrf.FailureReason(r))
+
+	data := map[string]interface{}{
+		csrf.TemplateTag: customTokenField(r),
+		"expired":        true,
+	}
+	uploaded := r.MultipartForm != nil && len(r.MultipartForm.File) > 0
+	if r.Method == http.MethodPost && sameOrigin(r) && !uploaded {
+		retry := &csrfRetry{Action: r.URL.RequestURI()}
+		names := []string{}
+		for name := range r.PostForm {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			switch name {
+			case "csrf-token":
+			case "password":
+				retry.Incomplete = true
+			default:
+				for _, value := range r.PostForm[name] {
+					retry.Fields = append(retry.Fields, csrfRetryField{name, value})
+				}
+			}
+		}
+		data["retry"] = retry
+	}
+	errorPageWithData(w, r, http.StatusForbidden, "Forbidden", data)
+}
+
+// sameOrigin reports whether the request's Origin, or else its Referer,
+// is this server.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Referer()
+	}
+	parsed, err := url.Parse(source)
+	return err == nil && source != "" && parsed.Host == r.Host
+}
+
+// currentSecrets returns the keyring used to sign session tokens.
+func currentSecrets() *keyring.Keyring {
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	return currentKeyring
+}
+
+// currentReceiptKey returns the key used to sign receipts.
+func currentReceiptKey() ed25519.PrivateKey {
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	return receiptKey
+}
+
+// currentMetricsToken returns the bearer token which lets a scraper read the metrics.
+func currentMetricsToken() string {
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	return metricsToken
+}
+
+// serveCSRFProtected serves the request with the router, protected
+// by the newest key's CSRF cookie. The cookie is marked Secure if the
+// request came over HTTPS.
+func serveCSRFProtected(w http.ResponseWriter, r *http.Request) {
+	secretsMutex.RLock()
+	handler := csrfProtected[csrfVariant{currentKeyring.Newest().ID, isSecureRequest(r)}]
+	secretsMutex.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+// reloadSecretFilesOnSIGHUP rereads the secret files each time the
+// process receives a SIGHUP.
+func reloadSecretFilesOnSIGHUP(router http.Handler) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	startBackgroundJob("reload secret files on SIGHUP", func(ctx context.Context) {
+		defer signal.Stop(hangups)
+		for {
+			select {
+			case <-hangups:
+				l.Log(l.InfoMessage, "SIGHUP received, reloading secret files.")
+				reloadSecretFiles(router)
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// reloadSecretFiles rereads the secret files and applies any changes.
+// If a file can't be read or its secret can't be used, the old secret is kept.
+func reloadSecretFiles(router http.Handler) {
+	changed := make(map[string]bool)
+	previous := make(map[string]string)
+	for name, path := range secretFiles {
+		value, err := readSecretFile(path)
+		if err != nil {
+			l.Logf(l.ErrorMessage, "Unable to reload %v, keeping the old value: %v", name, err)
+			continue
+		}
+		f := flag.Lookup(name)
+		if value == f.Value.String() {
+			continue
+		}
+		old := f.Value.String()
+		err = f.Value.Set(value)
+		if err != nil {
+			l.Logf(l.ErrorMessage, "Unable to reload %v, keeping the old value: %v", name, err)
+			f.Value.Set(old)
+			continue
+		}
+		changed[name] = true
+		previous[name] = old
+	}
+
+	if changed["secret"] || changed["receiptkey"] || changed["metricstoken"] {
+		err := applySecrets(router)
+		if err != nil {
+			l.Logf(l.ErrorMessage, "Unable to apply the reloaded secrets, keeping the old ones: %v", err)
+			// Put the old values back, so the flags match what is in use,
+			// and the files are tried again on the next reload.
+			for _, name := range []string{"secret", "receiptkey", "metricstoken"} {
+				if changed[name] {
+					flag.Lookup(name).Value.Set(previous[name])
+				}
+			}
+		} else {
+			l.Log(l.InfoMessage, "Reloaded the secret, receipt key and metrics token.")
+		}
+	}
+	if changed["dburl"] {
+		// Connections opened from now on use the new url.
+		db.SetURL(*databaseURL)
+		l.Log(l.InfoMessage, "Reloaded the database url.")
+	}
+	if changed["ldappass"] {
+		err := ldap.Rebind(*ldapBindUsername, *ldapBindPassword)
+		if err != nil {
+			l.Logf(l.ErrorMessage, "Unable to bind to LDAP with the reloaded password: %v", err)
+		} else {
+			l.Log(l.InfoMessage, "Reloaded the LDAP password.")
+		}
+	}
+	if changed["smtppass"] && smtpSender != nil {
+		smtpSender.SetPassword(*smtpPassword)
+		l.Log(l.InfoMessage, "Reloaded the SMTP password.")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/cu-library/signtwo/keyring"
+	jwt "github.com/dgrijalva/jwt-go"
+	"net/http"
+	"time"
+)
+
+// DefaultSessionLength is how long a signed session token is valid for.
+const DefaultSessionLength = time.Minute * 5
+
+// newSessionToken creates a JWT for the user, signed with the newest key.
+func newSessionToken(username string) (string, error) {
+	key := currentSecrets().Newest()
+	token := jwt.New(jwt.SigningMethodHS512)
+	token.Header["kid"] = key.ID
+	token.Claims["username"] = username
+	token.Claims["exp"] = time.Now().Add(DefaultSessionLength).Unix()
+	return token.SignedString(key.JWTKey())
+}
+
+// setSessionCookie stores the signed session token in the session cookie.
+// The cookie is marked Secure if the request came over HTTPS.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, tokenString string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     DefaultCookieName,
+		Value:    tokenString,
+		Path:     cookiePath(),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		Expires:  time.Now().Add(DefaultSessionLength),
+	})
+}
+
+// sessionUsername returns the username stored in the request's session cookie.
+// The second return value is false if there is no valid session.
+func sessionUsername(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(DefaultCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	token, err := jwt.Parse(cookie.Value, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		// Tokens issued before keys had IDs were signed with the default key.
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			kid = keyring.DefaultID
+		}
+		key, ok := currentSecrets().Accepted(kid, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("Unknown or retired key: %v", kid)
+		}
+		return key.JWTKey(), nil
+	})
+	if err != nil || !token.Valid {
+		return "", false
+	}
+
+	username, ok := token.Claims["username"].(string)
+	if !ok || username == "" {
+		return "", false
+	}
+	return username, true
+}
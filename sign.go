@@ -0,0 +1,221 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/cu-library/signtwo/audit"
+	"github.com/cu-library/signtwo/db"
+	"github.com/cu-library/signtwo/ldap"
+	l "github.com/cu-library/signtwo/loglevel"
+	"github.com/gorilla/csrf"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func agreementHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Agreement Handler visited.")
+
+	agreement, text, ok := loadCurrentAgreementText(w, r)
+	if !ok {
+		return
+	}
+
+	// Show the translation in the user's language, if there is one.
+	shown, err := db.TextInLanguage(text, languageFor(r))
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the translation of agreement text %v: %v", text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	text = shown
+
+	data := map[string]interface{}{
+		csrf.TemplateTag: customTokenField(r),
+		"agreement":      agreement,
+		"text":           text,
+		"contentSHA256":  db.ContentHash(text.Content),
+	}
+
+	if username, ok := sessionUsername(r); ok {
+		signature, err := db.GetUserSignature(username, text.ID)
+		if err != nil && err != sql.ErrNoRows {
+			logFor(r).Logf(l.ErrorMessage, "Unable to check if %v signed agreement text %v: %v", username, text.ID, err)
+			errorPage(w, r, http.StatusInternalServerError, "Database Error")
+			return
+		}
+		data["username"] = username
+		data["signature"] = signature
+
+		// Someone asked to sign again can see what changed since they last signed.
+		if signature == nil {
+			earlier, err := db.LatestUserSignature(username, agreement.ID)
+			if err != nil && err != sql.ErrNoRows {
+				logFor(r).Logf(l.ErrorMessage, "Unable to load the signature of %v on agreement %v: %v", username, agreement.ID, err)
+				errorPage(w, r, http.StatusInternalServerError, "Database Error")
+				return
+			}
+			data["signedEarlier"] = earlier
+		}
+	}
+
+	renderTemplateOr500(w, r, agreementTemplate, data)
+}
+
+func signPOSTHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Sign POST Handler visited.")
+
+	username, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	agreement, text, ok := loadCurrentAgreementText(w, r)
+	if !ok {
+		return
+	}
+
+	// The form records which text, language and content the user was shown.
+	// If any changed since, the user must read the agreement again.
+	textID, err := strconv.ParseInt(r.FormValue("text"), 10, 64)
+	if err != nil {
+		errorPage(w, r, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	language := r.FormValue("language")
+	if language == "" {
+		language = text.Language
+	}
+	shown, err := db.TextInLanguage(text, language)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the translation of agreement text %v: %v", text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	// The hash is of the content as stored, Markdown source included; see db.ContentHash.
+	contentSHA256 := db.ContentHash(shown.Content)
+	if textID != text.ID || shown.Language != language || r.FormValue("sha256") != contentSHA256 {
+		errorPage(w, r, http.StatusConflict, "The agreement changed while you were reading it. "+
+			"Please read the new version before signing.")
+		return
+	}
+
+	signed, err := db.HasSigned(username, text.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to check if %v signed agreement text %v: %v", username, text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	if signed {
+		setFlash(w, r, FlashInfo, "You've already signed this agreement.")
+		http.Redirect(w, r, urlFor("agreement", "id", agreement.ID), http.StatusSeeOther)
+		return
+	}
+
+	person, err := ldap.Lookup(username)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to look up %v in the directory: %v", username, err)
+		errorPage(w, r, http.StatusInternalServerError, "Directory Error")
+		return
+	}
+
+	signature := &db.Signature{
+		SignedAgreementTextID: text.ID,
+		Username:              username,
+		FirstName:             person.FirstName,
+		LastName:              person.LastName,
+		UserType:              db.UserType(person.UserType),
+		Email:                 person.Email,
+		Department:            person.Department,
+		BannerID:              person.BannerID,
+		SignedTimestampUTC:    time.Now().UTC(),
+		ContentSHA256:         contentSHA256,
+		Language:              shown.Language,
+	}
+	_, err = signature.Store()
+	if err == db.ErrContentChanged {
+		errorPage(w, r, http.StatusConflict, "The agreement changed while you were reading it. "+
+			"Please read the new version before signing.")
+		return
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to store signature of %v on agreement text %v: %v", username, text.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+	logFor(r).LogKV(l.InfoMessage, "Signed agreement text.", "username", username,
+		"agreement", agreement.ID, "agreement_text", text.ID, "language", shown.Language, "signature", signature.ID)
+	signaturesCounter.WithLabelValues(strconv.FormatInt(agreement.ID, 10)).Inc()
+	recordAudit(r, audit.Signature, username, fmt.Sprintf("agreement text %d", text.ID),
+		fmt.Sprintf("signature %d, language %v, content sha256 %v", signature.ID, shown.Language, contentSHA256))
+
+	// The receipt is generated now, while the signed content is known to be unchanged.
+	_, err = ensureReceipt(signature)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to create the receipt of signature %v: %v", signature.ID, err)
+	}
+	sendSignatureEmails(r, agreement, shown, signature)
+
+	setFlash(w, r, FlashSuccess, "Your signature has been recorded.")
+	http.Redirect(w, r, urlFor("agreement", "id", agreement.ID), http.StatusSeeOther)
+}
+
+func signaturesHandler(w http.ResponseWriter, r *http.Request) {
+	logFor(r).Log(l.TraceMessage, "Signatures Handler visited.")
+
+	agreement, ok := loadOwnedAgreement(w, r)
+	if !ok {
+		return
+	}
+
+	checks, err := db.VerifyAgreementSignatures(agreement.ID)
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to verify signatures of agreement %v: %v", agreement.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return
+	}
+
+	mismatches := 0
+	for _, check := range checks {
+		if check.Verifiable() && !check.Matches() {
+			mismatches++
+			logFor(r).Logf(l.WarnMessage, "Signature %v does not match the current content of agreement text %v.",
+				check.Signature.ID, check.Signature.SignedAgreementTextID)
+		}
+	}
+
+	renderTemplateOr500(w, r, signaturesTemplate, map[string]interface{}{
+		"agreement":  agreement,
+		"checks":     checks,
+		"mismatches": mismatches,
+	})
+}
+
+// loadCurrentAgreementText loads the enabled agreement named by the {id}
+// route variable and its current text, writing an error page and
+// returning false if it can't.
+func loadCurrentAgreementText(w http.ResponseWriter, r *http.Request) (*db.Agreement, *db.AgreementText, bool) {
+	agreement, ok := loadAgreement(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	if !agreement.Enabled {
+		fourOhFour(w, r)
+		return nil, nil, false
+	}
+
+	text, err := db.CurrentAgreementText(agreement.ID)
+	if err == sql.ErrNoRows {
+		fourOhFour(w, r)
+		return nil, nil, false
+	}
+	if err != nil {
+		logFor(r).Logf(l.ErrorMessage, "Unable to load the current text of agreement %v: %v", agreement.ID, err)
+		errorPage(w, r, http.StatusInternalServerError, "Database Error")
+		return nil, nil, false
+	}
+	return agreement, text, true
+}
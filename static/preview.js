@@ -0,0 +1,59 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Shows a live preview of Markdown under each textarea with a
+// data-preview attribute. The server renders and sanitizes the draft,
+// so the preview matches what signers will see.
+(function () {
+    "use strict";
+
+    // How long to wait after the last keystroke before rendering.
+    var delay = 300;
+
+    function attach(textarea) {
+        var form = textarea.form;
+        var token = form.querySelector("input[name='csrf-token']");
+        var preview = document.createElement("div");
+        preview.className = "preview";
+        preview.setAttribute("aria-live", "polite");
+        preview.setAttribute("aria-label", textarea.getAttribute("data-preview-label"));
+        if (textarea.lang) {
+            preview.lang = textarea.lang;
+        }
+        textarea.parentNode.insertBefore(preview, textarea.nextSibling);
+
+        var timer = null;
+        var request = null;
+        function render() {
+            if (request) {
+                request.abort();
+            }
+            var body = new URLSearchParams();
+            body.append("content", textarea.value);
+            if (token) {
+                body.append("csrf-token", token.value);
+            }
+            request = new XMLHttpRequest();
+            request.open("POST", textarea.getAttribute("data-preview"));
+            request.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+            request.onload = function () {
+                if (this.status === 200) {
+                    // The server's response is sanitized HTML.
+                    preview.innerHTML = this.responseText;
+                }
+            };
+            request.send(body.toString());
+        }
+        textarea.addEventListener("input", function () {
+            clearTimeout(timer);
+            timer = setTimeout(render, delay);
+        });
+        render();
+    }
+
+    var textareas = document.querySelectorAll("textarea[data-preview]");
+    for (var i = 0; i < textareas.length; i++) {
+        attach(textareas[i]);
+    }
+})();
@@ -0,0 +1,117 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	l "github.com/cu-library/signtwo/loglevel"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes.
+const DefaultCertificateCheckInterval = time.Second * 10
+
+// A certificateReloader serves a certificate and key from files,
+// loading them again when either file changes.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modified    time.Time
+	lastChecked time.Time
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	modified, err := reloader.latestModification()
+	if err != nil {
+		return nil, err
+	}
+	err = reloader.load(modified)
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// latestModification returns the later of the two files' modification times.
+func (reloader *certificateReloader) latestModification() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (reloader *certificateReloader) load(modified time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load the TLS certificate and key: %v", err)
+	}
+	reloader.certificate = &certificate
+	reloader.modified = modified
+	return nil
+}
+
+// GetCertificate is used as the tls.Config's GetCertificate. If the files
+// have changed but can't be loaded, the old certificate is kept.
+func (reloader *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	if time.Since(reloader.lastChecked) >= DefaultCertificateCheckInterval {
+		reloader.lastChecked = time.Now()
+		modified, err := reloader.latestModification()
+		if err != nil {
+			l.Logf(l.ErrorMessage, "Unable to check the TLS certificate files, keeping the old certificate: %v", err)
+		} else if !modified.Equal(reloader.modified) {
+			err = reloader.load(modified)
+			if err != nil {
+				l.Logf(l.ErrorMessage, "%v, keeping the old certificate.", err)
+			} else {
+				l.Log(l.InfoMessage, "Reloaded the TLS certificate.")
+			}
+		}
+	}
+	return reloader.certificate, nil
+}
+
+// httpsRedirectHandler redirects every request to the same url on the HTTPS address.
+func httpsRedirectHandler(tlsAddress string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// isSecureRequest reports whether the request reached us over HTTPS,
+// either directly or through a trusted proxy.
+func isSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return isTrustedProxy(r.RemoteAddr) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Compares two versions of a text word by word.
+//
+// The texts are split into words, runs of whitespace and punctuation,
+// and each distinct token is diffed as a single unit, so changes are
+// never shown as fragments of words.
+package worddiff
+
+import (
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"strings"
+	"unicode"
+)
+
+// An Op is what happened to a segment of text.
+type Op string
+
+const (
+	Equal  Op = "equal"
+	Insert Op = "insert"
+	Delete Op = "delete"
+)
+
+// A Segment is a run of text which was kept, inserted or deleted.
+type Segment struct {
+	Op   Op
+	Text string
+}
+
+// Diff returns the segments which turn old into new.
+func Diff(old, new string) []Segment {
+	tokens := &tokenTable{index: map[string]rune{}}
+	oldRunes, newRunes := tokens.encode(old), tokens.encode(new)
+
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMainRunes(oldRunes, newRunes, false)
+	diffs = dmp.DiffCleanupSemantic(diffs)
+
+	segments := []Segment{}
+	for _, d := range diffs {
+		op := Equal
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = Insert
+		case diffmatchpatch.DiffDelete:
+			op = Delete
+		}
+		segments = append(segments, Segment{Op: op, Text: tokens.decode(d.Text)})
+	}
+	return segments
+}
+
+// Changed reports whether any of the segments were inserted or deleted.
+func Changed(segments []Segment) bool {
+	for _, segment := range segments {
+		if segment.Op != Equal {
+			return true
+		}
+	}
+	return false
+}
+
+// A tokenTable gives each distinct token a rune, so texts can be
+// diffed as sequences of tokens.
+type tokenTable struct {
+	index  map[string]rune
+	tokens []string
+}
+
+func (table *tokenTable) encode(text string) []rune {
+	runes := []rune{}
+	for _, token := range split(text) {
+		r, ok := table.index[token]
+		if !ok {
+			// Skip the surrogate range, which isn't valid in strings.
+			r = rune(len(table.tokens) + 1)
+			if r >= 0xD800 {
+				r += 0x800
+			}
+			table.index[token] = r
+			table.tokens = append(table.tokens, token)
+		}
+		runes = append(runes, r)
+	}
+	return runes
+}
+
+func (table *tokenTable) decode(encoded string) string {
+	var b strings.Builder
+	for _, r := range encoded {
+		if r >= 0xD800+0x800 {
+			r -= 0x800
+		}
+		b.WriteString(table.tokens[r-1])
+	}
+	return b.String()
+}
+
+// split divides text into words, runs of whitespace, and
+// single punctuation marks or symbols.
+func split(text string) []string {
+	tokens := []string{}
+	start := 0
+	class := 0
+	for i, r := range text {
+		c := classOf(r)
+		if i > start && (c != class || c == punctuation) {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		class = c
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+const (
+	word = iota
+	space
+	punctuation
+)
+
+func classOf(r rune) int {
+	switch {
+	case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+		return word
+	case unicode.IsSpace(r):
+		return space
+	}
+	return punctuation
+}
@@ -0,0 +1,46 @@
+// Copyright 2015 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package worddiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+
+	expected := []string{"Loans", " ", "last", " ", "14", " ", "days", ".", "\n\n", "Renouvelez", "!"}
+	if tokens := split("Loans last 14 days.\n\nRenouvelez!"); !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Split into %q, expected %q", tokens, expected)
+	}
+}
+
+func TestDiff(t *testing.T) {
+
+	segments := Diff("Loans last 14 days. Fines apply.", "Loans last 21 days. Fines apply.")
+	expected := []Segment{
+		{Equal, "Loans last "},
+		{Delete, "14"},
+		{Insert, "21"},
+		{Equal, " days. Fines apply."},
+	}
+	if !reflect.DeepEqual(segments, expected) {
+		t.Errorf("Diffed into %q, expected %q", segments, expected)
+	}
+	if !Changed(segments) {
+		t.Error("The segments weren't reported as changed.")
+	}
+
+	// Whole words are replaced, never parts of them.
+	for _, segment := range Diff("The borrower", "The borrowers") {
+		if segment.Op == Insert && segment.Text == "s" {
+			t.Error("A change within a word was shown as a fragment.")
+		}
+	}
+
+	if Changed(Diff("Same text.", "Same text.")) {
+		t.Error("Identical texts were reported as changed.")
+	}
+}